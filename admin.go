@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// envEnabled reports whether the boolean env variable name is set to a true value
+func envEnabled(name string) bool {
+	r, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && r
+}
+
+// requireEnabled guards privileged handlers behind an env flag
+func requireEnabled(name string) error {
+	if !envEnabled(name) {
+		return fmt.Errorf("operation disabled, set %s=true to enable it", name)
+	}
+	return nil
+}
+
+func createUser(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname   string
+			username string
+			password string
+			roles    []interface{}
+		)
+
+		if err := requireEnabled("MONGO_ALLOW_USER_ADMIN"); err != nil {
+			return nil, err
+		}
+
+		if err := pod.DecodeArgs(args, &dbname, &username, &password, &roles); err != nil {
+			return nil, err
+		}
+
+		//roles can be plain role names or {"role": ..., "db": ...} maps
+		if roles == nil {
+			roles = []interface{}{}
+		}
+
+		var result bson.M
+		err := client.Database(dbname).RunCommand(ctx, bson.D{
+			{Key: "createUser", Value: username},
+			{Key: "pwd", Value: password},
+			{Key: "roles", Value: roles},
+		}).Decode(&result)
+		if err != nil {
+			//never include the password here
+			return nil, fmt.Errorf("createUser %s failed with: %w", username, err)
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+func dropUser(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname   string
+			username string
+		)
+
+		if err := requireEnabled("MONGO_ALLOW_USER_ADMIN"); err != nil {
+			return nil, err
+		}
+
+		if err := pod.DecodeArgs(args, &dbname, &username); err != nil {
+			return nil, err
+		}
+
+		var result bson.M
+		err := client.Database(dbname).RunCommand(ctx, bson.D{
+			{Key: "dropUser", Value: username},
+		}).Decode(&result)
+		if err != nil {
+			return nil, fmt.Errorf("dropUser %s failed with: %w", username, err)
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+func getParameter(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var name string
+
+		if err := pod.DecodeArgs(args, &name); err != nil {
+			return nil, err
+		}
+
+		//"*" asks for every parameter
+		cmd := bson.D{{Key: "getParameter", Value: "*"}}
+		if name != "*" {
+			cmd = bson.D{{Key: "getParameter", Value: 1}, {Key: name, Value: 1}}
+		}
+
+		var result bson.M
+		if err := client.Database("admin").RunCommand(ctx, cmd).Decode(&result); err != nil {
+			return nil, fmt.Errorf("getParameter %s failed with: %w", name, err)
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+func setParameter(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			name  string
+			value interface{}
+		)
+
+		if err := requireEnabled("MONGO_ALLOW_SET_PARAMETER"); err != nil {
+			return nil, err
+		}
+
+		if err := pod.DecodeArgs(args, &name, &value); err != nil {
+			return nil, err
+		}
+
+		var result bson.M
+		err := client.Database("admin").RunCommand(ctx, bson.D{
+			{Key: "setParameter", Value: 1},
+			{Key: name, Value: value},
+		}).Decode(&result)
+		if err != nil {
+			return nil, fmt.Errorf("setParameter %s failed with: %w", name, err)
+		}
+
+		return json.Marshal(result)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func aggregate(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawPipeline    json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawPipeline); err != nil {
+			return nil, err
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		coll, err := readCollection(conn, dbname, collectionName, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		pipeline, err := decodePipeline(rawPipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, err = sessionContext(ctx, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		//populate options
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if r, ok := boolOption(userOptions, "allow-disk-use"); ok {
+			opts.SetAllowDiskUse(r)
+		}
+
+		//let variables are referenced as $$name in the pipeline
+		if val, ok := userOptions["let"]; ok {
+			opts.SetLet(convertValue(val))
+		}
+
+		var results []bson.M
+		cursor, err := coll.Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate failed with: %w", err)
+		}
+		if err = cursor.All(ctx, &results); err != nil {
+			return nil, fmt.Errorf("aggregate cursor failed with: %w", err)
+		}
+
+		return encodeDocs(results, format)
+	}
+}
+
+// sample returns count random documents optionally limited to those matching a filter.
+// $sample uses a pseudo random cursor only when it is the first stage and count is small
+// relative to the collection, otherwise the server scans and sorts the input
+func sample(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			count          int64
+			rawFilter      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		//we can be called with 3, 4 or 5 arguments
+		if len(args) == 3 {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &count); err != nil {
+				return nil, err
+			}
+			applyDefaultOptions(ctx, &userOptions)
+		} else if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &count, &rawFilter); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		pipeline := mongo.Pipeline{}
+		if rawFilter != nil {
+			filter, err := decodeFilter(rawFilter, format, userOptions)
+			if err != nil {
+				return nil, err
+			}
+			if len(filter) > 0 {
+				pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+			}
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: count}}}})
+
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		var results []bson.M
+		cursor, err := conn.Database(dbname).Collection(collectionName).Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("sample failed with: %w", err)
+		}
+		if err = cursor.All(ctx, &results); err != nil {
+			return nil, fmt.Errorf("sample cursor failed with: %w", err)
+		}
+
+		return encodeDocs(results, format)
+	}
+}
+
+var fieldAggregateOps = map[string]string{
+	"sum": "$sum",
+	"avg": "$avg",
+	"min": "$min",
+	"max": "$max",
+}
+
+// preciseNumber keeps integral results as int64 so large values survive json
+func preciseNumber(v interface{}) interface{} {
+	switch t := v.(type) {
+	case int32:
+		return int64(t)
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < math.MaxInt64 {
+			return int64(t)
+		}
+	}
+	return v
+}
+
+// aggregateField computes a single sum, avg, min, max or count over a field
+func aggregateField(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			field          string
+			op             string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &field, &op); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		var accumulator bson.D
+		if op == "count" {
+			//count documents where the field is present
+			filter = append(filter, bson.E{Key: field, Value: bson.D{{Key: "$exists", Value: true}}})
+			accumulator = bson.D{{Key: "$sum", Value: 1}}
+		} else if operator, ok := fieldAggregateOps[op]; ok {
+			accumulator = bson.D{{Key: operator, Value: "$" + field}}
+		} else {
+			return nil, fmt.Errorf("unsupported op %s, expected sum, avg, min, max or count", op)
+		}
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: filter}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: nil},
+				{Key: "value", Value: accumulator},
+			}}},
+		}
+
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		var results []bson.M
+		cursor, err := conn.Database(dbname).Collection(collectionName).Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate-field failed with: %w", err)
+		}
+		if err = cursor.All(ctx, &results); err != nil {
+			return nil, fmt.Errorf("aggregate-field cursor failed with: %w", err)
+		}
+
+		//no matching documents
+		if len(results) == 0 {
+			if op == "count" || op == "sum" {
+				return json.Marshal(0)
+			}
+			return json.Marshal(nil)
+		}
+
+		return json.Marshal(preciseNumber(results[0]["value"]))
+	}
+}
+
+// facet runs several named sub-pipelines over the same input in one $facet stage
+// and returns the results of each pipeline under its name
+func facet(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFacets      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFacets); err != nil {
+			return nil, err
+		}
+
+		val, err := decodeOrdered(rawFacets)
+		if err != nil {
+			return nil, fmt.Errorf("trouble decoding facets: %w", err)
+		}
+		facets, ok := val.(bson.D)
+		if !ok || len(facets) == 0 {
+			return nil, fmt.Errorf("facets must be a non empty map of name to pipeline")
+		}
+		for _, e := range facets {
+			if _, ok := e.Value.(bson.A); !ok {
+				return nil, fmt.Errorf("facet %s must be a pipeline array", e.Key)
+			}
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		coll, err := readCollection(conn, dbname, collectionName, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if r, ok := boolOption(userOptions, "allow-disk-use"); ok {
+			opts.SetAllowDiskUse(r)
+		}
+
+		cursor, err := coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$facet", Value: facets}}}, opts)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate failed with: %w", err)
+		}
+		//$facet always produces exactly one document
+		var results []map[string][]bson.M
+		if err = cursor.All(ctx, &results); err != nil {
+			return nil, fmt.Errorf("aggregate cursor failed with: %w", err)
+		}
+		if len(results) != 1 {
+			return nil, fmt.Errorf("$facet returned %d documents", len(results))
+		}
+
+		out := make(map[string]json.RawMessage, len(facets))
+		for _, e := range facets {
+			docs := results[0][e.Key]
+			if docs == nil {
+				docs = []bson.M{}
+			}
+			if out[e.Key], err = encodeDocs(docs, format); err != nil {
+				return nil, err
+			}
+		}
+
+		return json.Marshal(out)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jlabath/netpod/server/pod"
+)
+
+// enabledVars reads the allowlist from NETPOD_ENABLED_VARS (comma separated)
+// or NETPOD_ENABLED_VARS_FILE (one name per line), nil means everything is enabled
+func enabledVars() (map[string]bool, error) {
+	var names []string
+	if val := os.Getenv("NETPOD_ENABLED_VARS"); val != "" {
+		names = strings.Split(val, ",")
+	} else if path := os.Getenv("NETPOD_ENABLED_VARS_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("trouble reading NETPOD_ENABLED_VARS_FILE: %w", err)
+		}
+		names = strings.Split(string(b), "\n")
+	} else {
+		return nil, nil
+	}
+	enabled := make(map[string]bool)
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" && !strings.HasPrefix(name, "#") {
+			enabled[name] = true
+		}
+	}
+	return enabled, nil
+}
+
+// filterVars keeps only the vars named in enabled either as var or namespace/var,
+// a name matching no var is an error so a typo does not quietly disable a handler
+func filterVars(namespaces []pod.Namespace, enabled map[string]bool) ([]pod.Namespace, error) {
+	if enabled == nil {
+		return namespaces, nil
+	}
+	used := make(map[string]bool, len(enabled))
+	var result []pod.Namespace
+	for _, ns := range namespaces {
+		var vars []pod.Var
+		for _, v := range ns.Vars {
+			qualified := ns.Name + "/" + v.Name
+			if enabled[v.Name] || enabled[qualified] {
+				vars = append(vars, v)
+				used[v.Name], used[qualified] = true, true
+			}
+		}
+		ns.Vars = vars
+		result = append(result, ns)
+	}
+	var unknown []string
+	for name := range enabled {
+		if !used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("enabled vars list names vars that do not exist: %s", strings.Join(unknown, ", "))
+	}
+	return result, nil
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSampleSize = 1000
+	maxSampleSize     = 100000
+)
+
+// sampleSizeOption reads the "sample-size" option bounded by maxSampleSize
+func sampleSizeOption(userOptions map[string]interface{}) int64 {
+	size, ok := intOption(userOptions, "sample-size")
+	if !ok || size <= 0 {
+		return defaultSampleSize
+	}
+	if size > maxSampleSize {
+		return maxSampleSize
+	}
+	return size
+}
+
+type selectivityResult struct {
+	Ratio      float64 `json:"ratio"`
+	Matched    int64   `json:"matched"`
+	SampleSize int64   `json:"sample-size"`
+}
+
+func selectivity(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		//count the sample and the matching part of it in one pass
+		pipeline := mongo.Pipeline{
+			{{Key: "$sample", Value: bson.D{{Key: "size", Value: sampleSizeOption(userOptions)}}}},
+			{{Key: "$facet", Value: bson.D{
+				{Key: "total", Value: bson.A{bson.D{{Key: "$count", Value: "n"}}}},
+				{Key: "matched", Value: bson.A{
+					bson.D{{Key: "$match", Value: filter}},
+					bson.D{{Key: "$count", Value: "n"}},
+				}},
+			}}},
+		}
+
+		var results []struct {
+			Total   []struct{ N int64 } `bson:"total"`
+			Matched []struct{ N int64 } `bson:"matched"`
+		}
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		cursor, err := client.Database(dbname).Collection(collectionName).Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("selectivity failed with: %w", err)
+		}
+		if err = cursor.All(ctx, &results); err != nil {
+			return nil, fmt.Errorf("selectivity cursor failed with: %w", err)
+		}
+
+		var r selectivityResult
+		if len(results) == 1 {
+			if len(results[0].Total) == 1 {
+				r.SampleSize = results[0].Total[0].N
+			}
+			if len(results[0].Matched) == 1 {
+				r.Matched = results[0].Matched[0].N
+			}
+		}
+		if r.SampleSize > 0 {
+			r.Ratio = float64(r.Matched) / float64(r.SampleSize)
+		}
+
+		return json.Marshal(r)
+	}
+}
+
+type digestResult struct {
+	Digest string `json:"digest"`
+	Count  int64  `json:"count"`
+}
+
+// collectionDigest xors the sha256 of every matching document so the digest
+// does not depend on the order documents are read in
+func collectionDigest(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		//we can be called with 2, 3 or 4 arguments
+		if len(args) == 2 {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName); err != nil {
+				return nil, err
+			}
+		} else if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter := bson.D{}
+		if rawFilter != nil {
+			if filter, err = decodeFilter(rawFilter, format, userOptions); err != nil {
+				return nil, err
+			}
+		}
+
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		cursor, err := client.Database(dbname).Collection(collectionName).Find(ctx, filter, opts)
+		if err != nil {
+			return nil, fmt.Errorf("collection-digest failed with: %w", err)
+		}
+		defer cursor.Close(ctx)
+
+		var (
+			acc   [sha256.Size]byte
+			count int64
+		)
+		for cursor.Next(ctx) {
+			sum := sha256.Sum256(cursor.Current)
+			for i := range acc {
+				acc[i] ^= sum[i]
+			}
+			count++
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, fmt.Errorf("collection-digest cursor failed with: %w", err)
+		}
+
+		return json.Marshal(digestResult{Digest: hex.EncodeToString(acc[:]), Count: count})
+	}
+}
+
+type sizeStats struct {
+	SampleSize int64   `json:"sample-size"`
+	Min        int     `json:"min"`
+	Max        int     `json:"max"`
+	Avg        float64 `json:"avg"`
+	P50        int     `json:"p50"`
+	P90        int     `json:"p90"`
+	P99        int     `json:"p99"`
+}
+
+// percentile picks the nearest rank from sorted sizes
+func percentile(sorted []int, p float64) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// docSizeStats reports the BSON size distribution of sampled documents
+func docSizeStats(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$sample", Value: bson.D{{Key: "size", Value: sampleSizeOption(userOptions)}}}},
+		}
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		cursor, err := client.Database(dbname).Collection(collectionName).Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("doc-size-stats failed with: %w", err)
+		}
+		defer cursor.Close(ctx)
+
+		//cursor.Current holds the raw BSON so its length is the document size
+		sizes := []int{}
+		total := 0
+		for cursor.Next(ctx) {
+			sizes = append(sizes, len(cursor.Current))
+			total += len(cursor.Current)
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, fmt.Errorf("doc-size-stats cursor failed with: %w", err)
+		}
+
+		stats := sizeStats{SampleSize: int64(len(sizes))}
+		if len(sizes) > 0 {
+			sort.Ints(sizes)
+			stats.Min, stats.Max = sizes[0], sizes[len(sizes)-1]
+			stats.Avg = float64(total) / float64(len(sizes))
+			stats.P50 = percentile(sizes, 0.50)
+			stats.P90 = percentile(sizes, 0.90)
+			stats.P99 = percentile(sizes, 0.99)
+		}
+
+		return json.Marshal(stats)
+	}
+}
+
+type fieldStats struct {
+	Count int64
+	Types map[string]int64
+}
+
+type schemaSample struct {
+	Size   int64
+	Fields map[string]*fieldStats
+}
+
+// addFields records the type of every field of doc, sub documents use dotted paths
+func (s *schemaSample) addFields(prefix string, doc bson.Raw) error {
+	elements, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+	for _, el := range elements {
+		path := prefix + el.Key()
+		val := el.Value()
+		stats, ok := s.Fields[path]
+		if !ok {
+			stats = &fieldStats{Types: map[string]int64{}}
+			s.Fields[path] = stats
+		}
+		stats.Count++
+		stats.Types[val.Type.String()]++
+		if sub, ok := val.DocumentOK(); ok {
+			if err := s.addFields(path+".", sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inferSchema samples a collection and records field presence and types
+func inferSchema(ctx context.Context, coll *mongo.Collection, size int64) (*schemaSample, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}},
+	}
+	opts := options.Aggregate()
+	if comment, ok := correlationComment(ctx); ok {
+		opts.SetComment(comment)
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, fmt.Errorf("sampling %s failed with: %w", coll.Name(), err)
+	}
+	defer cursor.Close(ctx)
+
+	s := &schemaSample{Fields: map[string]*fieldStats{}}
+	for cursor.Next(ctx) {
+		if err := s.addFields("", cursor.Current); err != nil {
+			return nil, err
+		}
+		s.Size++
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("sampling %s cursor failed with: %w", coll.Name(), err)
+	}
+	return s, nil
+}
+
+func (s *schemaSample) frequency(field string) float64 {
+	if s.Size == 0 {
+		return 0
+	}
+	return float64(s.Fields[field].Count) / float64(s.Size)
+}
+
+func (s *schemaSample) typeNames(field string) []string {
+	names := []string{}
+	for name := range s.Fields[field].Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type typeMismatch struct {
+	Field string   `json:"field"`
+	Left  []string `json:"left"`
+	Right []string `json:"right"`
+}
+
+type frequencyDiff struct {
+	Field string  `json:"field"`
+	Left  float64 `json:"left"`
+	Right float64 `json:"right"`
+}
+
+type schemaDiff struct {
+	OnlyLeft        []string        `json:"only-left"`
+	OnlyRight       []string        `json:"only-right"`
+	TypeMismatches  []typeMismatch  `json:"type-mismatches"`
+	FrequencyDiffs  []frequencyDiff `json:"frequency-differences"`
+	LeftSampleSize  int64           `json:"left-sample-size"`
+	RightSampleSize int64           `json:"right-sample-size"`
+}
+
+const defaultFrequencyThreshold = 0.1
+
+// compareSchemas samples two collections and reports how their shapes differ
+func compareSchemas(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			leftDb, leftColl   string
+			rightDb, rightColl string
+			userOptions        map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &leftDb, &leftColl, &rightDb, &rightColl); err != nil {
+			return nil, err
+		}
+
+		size := sampleSizeOption(userOptions)
+		threshold := defaultFrequencyThreshold
+		if val, ok := userOptions["frequency-threshold"].(float64); ok {
+			threshold = val
+		}
+
+		left, err := inferSchema(ctx, client.Database(leftDb).Collection(leftColl), size)
+		if err != nil {
+			return nil, err
+		}
+		right, err := inferSchema(ctx, client.Database(rightDb).Collection(rightColl), size)
+		if err != nil {
+			return nil, err
+		}
+
+		diff := schemaDiff{
+			OnlyLeft:        []string{},
+			OnlyRight:       []string{},
+			TypeMismatches:  []typeMismatch{},
+			FrequencyDiffs:  []frequencyDiff{},
+			LeftSampleSize:  left.Size,
+			RightSampleSize: right.Size,
+		}
+		fields := []string{}
+		for field := range left.Fields {
+			fields = append(fields, field)
+		}
+		for field := range right.Fields {
+			if _, ok := left.Fields[field]; !ok {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			_, inLeft := left.Fields[field]
+			_, inRight := right.Fields[field]
+			switch {
+			case !inRight:
+				diff.OnlyLeft = append(diff.OnlyLeft, field)
+			case !inLeft:
+				diff.OnlyRight = append(diff.OnlyRight, field)
+			default:
+				lt, rt := left.typeNames(field), right.typeNames(field)
+				if strings.Join(lt, ",") != strings.Join(rt, ",") {
+					diff.TypeMismatches = append(diff.TypeMismatches, typeMismatch{Field: field, Left: lt, Right: rt})
+				}
+				lf, rf := left.frequency(field), right.frequency(field)
+				if math.Abs(lf-rf) > threshold {
+					diff.FrequencyDiffs = append(diff.FrequencyDiffs, frequencyDiff{Field: field, Left: lf, Right: rf})
+				}
+			}
+		}
+
+		return json.Marshal(diff)
+	}
+}
+
+var dateTruncUnits = map[string]bool{"hour": true, "day": true, "month": true}
+
+type dateBucket struct {
+	Bucket taggedDate `json:"bucket"`
+	Count  int64      `json:"count"`
+}
+
+// countByDate counts the documents matching a filter per hour, day or month of a date field,
+// buckets are returned in order and documents without the date are not counted
+func countByDate(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			field          string
+			granularity    string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &field, &granularity); err != nil {
+			return nil, err
+		}
+		if !dateTruncUnits[granularity] {
+			return nil, fmt.Errorf("unsupported granularity %s, use hour, day or month", granularity)
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		trunc := bson.D{
+			{Key: "date", Value: "$" + field},
+			{Key: "unit", Value: granularity},
+		}
+		if val, ok := userOptions["timezone"]; ok {
+			tz, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value for timezone: %v", val)
+			}
+			trunc = append(trunc, bson.E{Key: "timezone", Value: tz})
+		}
+
+		//$dateTrunc needs MongoDB 5.0
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: filter}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{{Key: "$dateTrunc", Value: trunc}}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			{{Key: "$match", Value: bson.D{{Key: "_id", Value: bson.D{{Key: "$ne", Value: nil}}}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		}
+
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		cursor, err := client.Database(dbname).Collection(collectionName).Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("count-by-date failed with: %w", err)
+		}
+		var groups []struct {
+			Bucket primitive.DateTime `bson:"_id"`
+			Count  int64              `bson:"count"`
+		}
+		if err = cursor.All(ctx, &groups); err != nil {
+			return nil, fmt.Errorf("count-by-date cursor failed with: %w", err)
+		}
+
+		buckets := make([]dateBucket, len(groups))
+		for i, g := range groups {
+			buckets[i] = dateBucket{Bucket: newTaggedDate(g.Bucket), Count: g.Count}
+		}
+
+		return json.Marshal(buckets)
+	}
+}
+
+type fieldCardinality struct {
+	Present         int64   `json:"present"`
+	SampledDistinct int64   `json:"sampled-distinct"`
+	Estimate        float64 `json:"estimate"`
+}
+
+type cardinalityResult struct {
+	SampleSize int64                        `json:"sample-size"`
+	Documents  int64                        `json:"documents"`
+	Fields     map[string]*fieldCardinality `json:"fields"`
+}
+
+// fieldCardinalityStats estimates the distinct values of every top level field from a sample.
+// The estimate scales the values seen once by sqrt(documents/sample) and counts the
+// values seen more often as is (the GEE estimator), it is exact when the sample is the
+// whole collection.
+func fieldCardinalityStats(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		coll := client.Database(dbname).Collection(collectionName)
+		total, err := coll.EstimatedDocumentCount(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("count failed with: %w", err)
+		}
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$sample", Value: bson.D{{Key: "size", Value: sampleSizeOption(userOptions)}}}},
+		}
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		cursor, err := coll.Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("field-cardinality failed with: %w", err)
+		}
+		defer cursor.Close(ctx)
+
+		seen := map[string]map[string]int64{}
+		result := cardinalityResult{Documents: total, Fields: map[string]*fieldCardinality{}}
+		for cursor.Next(ctx) {
+			var doc bson.D
+			if err := cursor.Decode(&doc); err != nil {
+				return nil, fmt.Errorf("trouble decoding document: %w", err)
+			}
+			result.SampleSize++
+			for _, e := range doc {
+				key, err := distinctKey(e.Value)
+				if err != nil {
+					return nil, err
+				}
+				if seen[e.Key] == nil {
+					seen[e.Key] = map[string]int64{}
+					result.Fields[e.Key] = &fieldCardinality{}
+				}
+				seen[e.Key][key]++
+				result.Fields[e.Key].Present++
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, fmt.Errorf("field-cardinality cursor failed with: %w", err)
+		}
+
+		scale := 1.0
+		if result.SampleSize > 0 && total > result.SampleSize {
+			scale = math.Sqrt(float64(total) / float64(result.SampleSize))
+		}
+		for field, counts := range seen {
+			var once, more int64
+			for _, n := range counts {
+				if n == 1 {
+					once++
+				} else {
+					more++
+				}
+			}
+			f := result.Fields[field]
+			f.SampledDistinct = once + more
+			f.Estimate = scale*float64(once) + float64(more)
+		}
+
+		return json.Marshal(result)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const auditTimeout = 5 * time.Second
+
+// auditNamespace splits MONGO_AUDIT_COLLECTION into a database and a collection,
+// a bare collection name lives in the database of each audited write
+func auditNamespace() (string, string) {
+	ns := os.Getenv("MONGO_AUDIT_COLLECTION")
+	if i := strings.Index(ns, "."); i > 0 {
+		return ns[:i], ns[i+1:]
+	}
+	return "", ns
+}
+
+// auditMaxParamBytes is the largest argument copied into an audit document as is
+const auditMaxParamBytes = 1024
+
+// auditParam is the form of one write argument kept in the audit collection. A uri option
+// has its credentials redacted, arrays such as the documents of insert-many and larger
+// documents are summarised by their count and size instead of being copied.
+func auditParam(arg json.RawMessage) interface{} {
+	v, err := decodeOrdered(arg)
+	if err != nil {
+		return string(arg)
+	}
+	switch t := v.(type) {
+	case bson.A:
+		//filter tuples are arrays of arrays and are kept while small
+		documents := false
+		for _, item := range t {
+			if _, ok := item.(bson.D); ok {
+				documents = true
+			}
+		}
+		if documents || len(arg) > auditMaxParamBytes {
+			return bson.D{{Key: "count", Value: len(t)}, {Key: "bytes", Value: len(arg)}}
+		}
+	case bson.D:
+		if uri, ok := docValue(t, "uri").(string); ok {
+			redactedDoc := make(bson.D, len(t))
+			for i, e := range t {
+				if e.Key == "uri" {
+					e.Value = redactURI(uri)
+				}
+				redactedDoc[i] = e
+			}
+			return redactedDoc
+		}
+		if len(arg) > auditMaxParamBytes {
+			return bson.D{{Key: "bytes", Value: len(arg)}}
+		}
+	}
+	return v
+}
+
+// withAudit appends a document recording each successful write to the collection
+// named by MONGO_AUDIT_COLLECTION. The audit insert runs in the background after the
+// write and only logs its failures so it never holds up or fails the write itself.
+func withAudit(client *mongo.Client, op string, h pod.Handler) pod.Handler {
+	auditDB, auditColl := auditNamespace()
+	if auditColl == "" {
+		return h
+	}
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		value, err := h(ctx, args)
+		if err != nil {
+			return value, err
+		}
+
+		//write handlers all start with db and collection
+		var dbname, collectionName string
+		if len(args) >= 2 {
+			_ = json.Unmarshal(args[0], &dbname)
+			_ = json.Unmarshal(args[1], &collectionName)
+		}
+		params := bson.A{}
+		for _, arg := range args[min(len(args), 2):] {
+			params = append(params, auditParam(arg))
+		}
+		doc := bson.D{
+			{Key: "op", Value: op},
+			{Key: "db", Value: dbname},
+			{Key: "collection", Value: collectionName},
+			{Key: "args", Value: params},
+			{Key: "at", Value: time.Now().UTC()},
+		}
+		if id := correlationID(args); id != "" {
+			doc = append(doc, bson.E{Key: "correlation-id", Value: id})
+		}
+
+		target := auditDB
+		if target == "" {
+			target = dbname
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+			defer cancel()
+			if _, err := client.Database(target).Collection(auditColl).InsertOne(ctx, doc); err != nil {
+				log.Printf("audit of %s on %s.%s failed with: %v", op, dbname, collectionName, err)
+			}
+		}()
+
+		return value, nil
+	}
+}
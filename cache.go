@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+)
+
+const maxCachedResults = 256
+
+type cachedResult struct {
+	key     string
+	value   json.RawMessage
+	expires time.Time
+}
+
+// resultCache is a bounded LRU of serialized results.
+// Entries only expire by time, writes do not evict them.
+type resultCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+var cachedResults = &resultCache{order: list.New(), entries: make(map[string]*list.Element)}
+
+func (c *resultCache) get(key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cachedResult)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *resultCache) set(key string, value json.RawMessage, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&cachedResult{key: key, value: value, expires: time.Now().Add(ttl)})
+	for c.order.Len() > maxCachedResults {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).key)
+	}
+}
+
+// withResultCache serves repeated calls from memory when the options carry "cache-ms".
+// The key covers the var name and every argument so db, collection, filter and options all count,
+// except the correlation id which differs between otherwise identical calls.
+// Calls bound to a session are never cached so one session cannot read another's results.
+func withResultCache(name string, h pod.Handler) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var callOptions map[string]interface{}
+		if len(args) > 0 {
+			//the trailing argument is not always an options map
+			_ = json.Unmarshal(args[len(args)-1], &callOptions)
+		}
+		//merging the defaults builds a new map, callOptions stays as given
+		userOptions := callOptions
+		applyDefaultOptions(ctx, &userOptions)
+		ms, ok := intOption(userOptions, "cache-ms")
+		if !ok || ms <= 0 {
+			return h(ctx, args)
+		}
+		if _, ok := userOptions["session"]; ok {
+			return h(ctx, args)
+		}
+
+		key, err := resultCacheKey(name, args, callOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		if value, ok := cachedResults.get(key); ok {
+			return value, nil
+		}
+		value, err := h(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		cachedResults.set(key, value, time.Duration(ms)*time.Millisecond)
+		return value, nil
+	}
+}
+
+// resultCacheKey hashes the var name and args, a trailing options map is hashed
+// without its "correlation-id"
+func resultCacheKey(name string, args []json.RawMessage, callOptions map[string]interface{}) (string, error) {
+	hash := sha256.New()
+	hash.Write([]byte(name))
+	for i, arg := range args {
+		if i == len(args)-1 && callOptions != nil {
+			if _, ok := callOptions["correlation-id"]; ok {
+				trimmed := make(map[string]interface{}, len(callOptions))
+				for k, v := range callOptions {
+					if k != "correlation-id" {
+						trimmed[k] = v
+					}
+				}
+				b, err := json.Marshal(trimmed)
+				if err != nil {
+					return "", err
+				}
+				arg = b
+			}
+		}
+		hash.Write([]byte{0})
+		hash.Write(arg)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// TestResultCacheIgnoresCorrelationID checks calls differing only in their
+// correlation id share a cache entry while session bound calls always run
+func TestResultCacheIgnoresCorrelationID(t *testing.T) {
+	var calls int
+	h := withResultCache("cache-test", func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		calls++
+		return json.RawMessage(`[]`), nil
+	})
+	call := func(options string) {
+		args := []json.RawMessage{json.RawMessage(`"db"`), json.RawMessage(`"coll"`), json.RawMessage(`{"a": 1}`), json.RawMessage(options)}
+		if _, err := h(context.Background(), args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	call(`{"cache-ms": 60000, "correlation-id": "one"}`)
+	call(`{"cache-ms": 60000, "correlation-id": "two"}`)
+	if calls != 1 {
+		t.Errorf("calls differing by correlation id ran %d times, want 1", calls)
+	}
+
+	calls = 0
+	call(`{"cache-ms": 60000, "session": "s1"}`)
+	call(`{"cache-ms": 60000, "session": "s1"}`)
+	if calls != 2 {
+		t.Errorf("session bound calls ran %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type activeCall struct {
+	cancel context.CancelFunc
+}
+
+// callRegistry tracks in-flight handler calls by their correlation id
+type callRegistry struct {
+	mu    sync.Mutex
+	calls map[string]*activeCall
+}
+
+var activeCalls = &callRegistry{calls: make(map[string]*activeCall)}
+
+func (r *callRegistry) add(id string, call *activeCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[id] = call
+}
+
+func (r *callRegistry) remove(id string, call *activeCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	//a later call may have reused the id
+	if r.calls[id] == call {
+		delete(r.calls, id)
+	}
+}
+
+func (r *callRegistry) cancel(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	call, ok := r.calls[id]
+	if ok {
+		call.cancel()
+		delete(r.calls, id)
+	}
+	return ok
+}
+
+// correlationID returns the "correlation-id" of the trailing options argument if any
+func correlationID(args []json.RawMessage) string {
+	if len(args) == 0 {
+		return ""
+	}
+	var opts struct {
+		CorrelationID string `json:"correlation-id"`
+	}
+	if err := json.Unmarshal(args[len(args)-1], &opts); err != nil {
+		return ""
+	}
+	return opts.CorrelationID
+}
+
+type correlationKey struct{}
+
+// correlationComment returns the correlation id of the call, handlers attach
+// it as the comment of their operations so it shows up in system.profile and the server log
+func correlationComment(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationKey{}).(string)
+	return id, ok
+}
+
+// withCorrelation makes calls carrying a correlation id cancellable through the cancel handler
+func withCorrelation(h pod.Handler) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		id := correlationID(args)
+		if id == "" {
+			return h(ctx, args)
+		}
+
+		ctx, cancel := context.WithCancel(context.WithValue(ctx, correlationKey{}, id))
+		defer cancel()
+
+		call := &activeCall{cancel: cancel}
+		activeCalls.add(id, call)
+		defer activeCalls.remove(id, call)
+
+		return h(ctx, args)
+	}
+}
+
+func cancelCall() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var id string
+
+		if err := pod.DecodeArgs(args, &id); err != nil {
+			return nil, err
+		}
+
+		//false when no call with that id is running
+		return json.Marshal(activeCalls.cancel(id))
+	}
+}
+
+// findOpByCorrelation searches system.profile for the operations commented with a correlation id,
+// the profiler has to be enabled on the database
+func findOpByCorrelation(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname      string
+			id          string
+			userOptions map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &id); err != nil {
+			return nil, err
+		}
+
+		limit := int64(defaultProfileLimit)
+		if r, ok := intOption(userOptions, "limit"); ok && r > 0 {
+			limit = r
+		}
+
+		//getMore entries carry the comment of the originating command
+		filter := bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "command.comment", Value: id}},
+			bson.D{{Key: "originatingCommand.comment", Value: id}},
+		}}}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "ts", Value: -1}}).
+			SetLimit(limit)
+		cursor, err := client.Database(dbname).Collection("system.profile").Find(ctx, filter, opts)
+		if err != nil {
+			return nil, fmt.Errorf("reading system.profile failed with: %w", err)
+		}
+		entries := []bson.M{}
+		if err = cursor.All(ctx, &entries); err != nil {
+			return nil, fmt.Errorf("system.profile cursor failed with: %w", err)
+		}
+
+		return json.Marshal(entries)
+	}
+}
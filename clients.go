@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxCachedClients = 8
+	clientIdleExpiry = 5 * time.Minute
+)
+
+type cachedClient struct {
+	client   *mongo.Client
+	uri      string
+	lastUsed time.Time
+	//calls currently using client, it is only disconnected once this is back to zero
+	refs int
+	//removed from the cache while still in use
+	evicted bool
+}
+
+// clientCache holds clients for ad-hoc "uri" targets keyed by the uri hash
+type clientCache struct {
+	mu      sync.Mutex
+	clients map[string]*cachedClient
+}
+
+var adhocClients = &clientCache{clients: make(map[string]*cachedClient)}
+
+// get returns the client for uri together with the release func the caller
+// has to call once it is done with the client
+func (c *clientCache) get(ctx context.Context, uri string) (*mongo.Client, func(), error) {
+	sum := sha256.Sum256([]byte(uri))
+	key := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	cached, ok := c.clients[key]
+	if !ok {
+		if len(c.clients) >= maxCachedClients {
+			c.evictOldest()
+		}
+
+		client, err := mongo.Connect(ctx, applyProxy(options.Client().ApplyURI(uri)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("connecting to %s failed with: %w", redactURI(uri), redactError(err))
+		}
+		log.Printf("Connected to ad-hoc target %s", redactURI(uri))
+		cached = &cachedClient{client: client, uri: uri}
+		c.clients[key] = cached
+	}
+	cached.lastUsed = now
+	cached.refs++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { c.release(cached) })
+	}
+	return cached.client, release, nil
+}
+
+// release ends one use of cached, an evicted client is disconnected by its last user
+func (c *clientCache) release(cached *cachedClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached.refs--
+	cached.lastUsed = time.Now()
+	if cached.evicted && cached.refs == 0 {
+		c.disconnect(cached)
+	}
+}
+
+// expire disconnects clients nobody uses that sat idle for longer than clientIdleExpiry, c.mu must be held
+func (c *clientCache) expire(now time.Time) {
+	for key, cached := range c.clients {
+		if cached.refs == 0 && now.Sub(cached.lastUsed) > clientIdleExpiry {
+			c.remove(key)
+		}
+	}
+}
+
+// evictOldest removes the least recently used client preferring ones nobody uses, c.mu must be held
+func (c *clientCache) evictOldest() {
+	oldest := func(unusedOnly bool) string {
+		var (
+			oldestKey string
+			oldest    time.Time
+		)
+		for key, cached := range c.clients {
+			if unusedOnly && cached.refs > 0 {
+				continue
+			}
+			if oldestKey == "" || cached.lastUsed.Before(oldest) {
+				oldestKey, oldest = key, cached.lastUsed
+			}
+		}
+		return oldestKey
+	}
+	key := oldest(true)
+	if key == "" {
+		key = oldest(false)
+	}
+	if key != "" {
+		c.remove(key)
+	}
+}
+
+// remove takes a client out of the cache, it is disconnected right away
+// when unused or else by the release of its last user, c.mu must be held
+func (c *clientCache) remove(key string) {
+	cached := c.clients[key]
+	delete(c.clients, key)
+	cached.evicted = true
+	if cached.refs == 0 {
+		c.disconnect(cached)
+	}
+}
+
+func (c *clientCache) disconnect(cached *cachedClient) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := cached.client.Disconnect(ctx); err != nil {
+			log.Printf("trouble disconnecting from %s: %v", redactURI(cached.uri), redactError(err))
+		}
+	}()
+}
+
+// resolveClient returns the client for the "uri" option or the default client,
+// release has to be called once the call no longer uses the client
+func resolveClient(ctx context.Context, client *mongo.Client, userOptions map[string]interface{}) (*mongo.Client, func(), error) {
+	val, ok := userOptions["uri"]
+	if !ok {
+		return client, func() {}, nil
+	}
+	uri, ok := val.(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected value for uri")
+	}
+	return adhocClients.get(ctx, uri)
+}
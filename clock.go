@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// serverTime returns the clock of the server the client talks to as reported by hello
+func serverTime(ctx context.Context, client *mongo.Client) (time.Time, error) {
+	var hello struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "hello", Value: 1},
+	}).Decode(&hello)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("hello failed with: %w", err)
+	}
+	if hello.LocalTime.IsZero() {
+		return time.Time{}, fmt.Errorf("hello did not report localTime")
+	}
+	return hello.LocalTime.UTC(), nil
+}
+
+// serverTimeHandler returns the server clock as an ISODate tag
+func serverTimeHandler(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		now, err := serverTime(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(newTaggedDate(primitive.NewDateTimeFromTime(now)))
+	}
+}
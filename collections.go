@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type collectionSpec struct {
+	Name    string `bson:"name"`
+	Type    string `bson:"type"`
+	Options bson.D `bson:"options"`
+}
+
+// readCollectionSpec returns the listCollections entry for collectionName
+func readCollectionSpec(ctx context.Context, database *mongo.Database, collectionName string) (*collectionSpec, error) {
+	cursor, err := database.ListCollections(ctx, bson.D{{Key: "name", Value: collectionName}})
+	if err != nil {
+		return nil, fmt.Errorf("trouble when ListCollections: %w", err)
+	}
+	var specs []collectionSpec
+	if err = cursor.All(ctx, &specs); err != nil {
+		return nil, fmt.Errorf("listCollections cursor failed with: %w", err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("collection %s.%s does not exist", database.Name(), collectionName)
+	}
+	return &specs[0], nil
+}
+
+// readIndexSpecs returns the index specs of coll without the default _id index
+func readIndexSpecs(ctx context.Context, coll *mongo.Collection) ([]bson.D, error) {
+	cursor, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listIndexes failed with: %w", err)
+	}
+	var all []bson.D
+	if err = cursor.All(ctx, &all); err != nil {
+		return nil, fmt.Errorf("listIndexes cursor failed with: %w", err)
+	}
+	specs := []bson.D{}
+	for _, spec := range all {
+		if docValue(spec, "name") == "_id_" {
+			continue
+		}
+		//the version and namespace are assigned by the server
+		clean := bson.D{}
+		for _, e := range spec {
+			if e.Key != "v" && e.Key != "ns" {
+				clean = append(clean, e)
+			}
+		}
+		specs = append(specs, clean)
+	}
+	return specs, nil
+}
+
+type truncateResult struct {
+	Options bson.M   `json:"options"`
+	Indexes []string `json:"indexes"`
+}
+
+// droppedStructure describes what truncate-collection dropped as extended json
+// so a failed rebuild can be finished by hand
+func droppedStructure(spec *collectionSpec, indexes []bson.D) string {
+	saved, err := bson.MarshalExtJSON(bson.D{
+		{Key: "options", Value: spec.Options},
+		{Key: "indexes", Value: indexes},
+	}, true, false)
+	if err != nil {
+		return fmt.Sprintf("the dropped structure could not be encoded: %v", err)
+	}
+	return fmt.Sprintf("the collection was dropped, rebuild it from %s", saved)
+}
+
+// truncateCollection drops and recreates a collection keeping its options and indexes,
+// it needs MONGO_ALLOW_TRUNCATE
+func truncateCollection(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+		)
+
+		if err := requireEnabled("MONGO_ALLOW_TRUNCATE"); err != nil {
+			return nil, err
+		}
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		database := client.Database(dbname)
+		coll := database.Collection(collectionName)
+
+		//read the structure first so it can be rebuilt after the drop
+		spec, err := readCollectionSpec(ctx, database, collectionName)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Type == "view" {
+			return nil, fmt.Errorf("%s is a view and cannot be truncated", collectionName)
+		}
+		indexes, err := readIndexSpecs(ctx, coll)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := coll.Drop(ctx); err != nil {
+			return nil, fmt.Errorf("drop failed with: %w", err)
+		}
+
+		create := append(bson.D{{Key: "create", Value: collectionName}}, spec.Options...)
+		if err := database.RunCommand(ctx, create).Err(); err != nil {
+			return nil, fmt.Errorf("recreating %s failed with: %w, %s", collectionName, err, droppedStructure(spec, indexes))
+		}
+
+		preserved, err := toM(spec.Options)
+		if err != nil {
+			return nil, err
+		}
+		result := truncateResult{Options: preserved, Indexes: []string{}}
+		if len(indexes) > 0 {
+			err := database.RunCommand(ctx, bson.D{
+				{Key: "createIndexes", Value: collectionName},
+				{Key: "indexes", Value: indexes},
+			}).Err()
+			if err != nil {
+				return nil, fmt.Errorf("rebuilding indexes of %s failed with: %w, %s", collectionName, err, droppedStructure(spec, indexes))
+			}
+		}
+		for _, index := range indexes {
+			if name, ok := docValue(index, "name").(string); ok {
+				result.Indexes = append(result.Indexes, name)
+			}
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+func listCollectionsFull(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var dbname string
+
+		if err := pod.DecodeArgs(args, &dbname); err != nil {
+			return nil, err
+		}
+
+		//each entry has name, type (collection, view or timeseries), options and info
+		cursor, err := client.Database(dbname).ListCollections(ctx, bson.D{})
+		if err != nil {
+			return nil, fmt.Errorf("trouble when ListCollections: %w", err)
+		}
+		results := []bson.M{}
+		if err = cursor.All(ctx, &results); err != nil {
+			return nil, fmt.Errorf("listCollections cursor failed with: %w", err)
+		}
+
+		return json.Marshal(results)
+	}
+}
+
+func createView(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname      string
+			viewName    string
+			source      string
+			rawPipeline json.RawMessage
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &viewName, &source, &rawPipeline); err != nil {
+			return nil, err
+		}
+
+		pipeline, err := decodePipeline(rawPipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		database := client.Database(dbname)
+
+		//the server happily creates views on missing collections so check first
+		if _, err := readCollectionSpec(ctx, database, source); err != nil {
+			return nil, fmt.Errorf("cannot create view %s: %w", viewName, err)
+		}
+
+		if err := database.CreateView(ctx, viewName, source, pipeline); err != nil {
+			return nil, fmt.Errorf("createView failed with: %w", err)
+		}
+
+		return json.Marshal(viewName)
+	}
+}
+
+func dropView(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname   string
+			viewName string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &viewName); err != nil {
+			return nil, err
+		}
+
+		database := client.Database(dbname)
+
+		//refuse to drop a real collection through this handler
+		spec, err := readCollectionSpec(ctx, database, viewName)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Type != "view" {
+			return nil, fmt.Errorf("%s is not a view", viewName)
+		}
+
+		if err := database.Collection(viewName).Drop(ctx); err != nil {
+			return nil, fmt.Errorf("drop of view %s failed with: %w", viewName, err)
+		}
+
+		return json.Marshal(viewName)
+	}
+}
+
+type collModChanges struct {
+	Index *struct {
+		Name               string `json:"name"`
+		ExpireAfterSeconds *int64 `json:"expire-after-seconds"`
+	} `json:"index"`
+	CappedSize *int64          `json:"capped-size"`
+	CappedMax  *int64          `json:"capped-max"`
+	Validator  json.RawMessage `json:"validator"`
+}
+
+// command builds the collMod command, each call changes either a ttl index,
+// the capped limits (server 6.0+) or the validator
+func (c *collModChanges) command(collectionName string) (bson.D, error) {
+	kinds := 0
+	if c.Index != nil {
+		kinds++
+	}
+	if c.CappedSize != nil || c.CappedMax != nil {
+		kinds++
+	}
+	if c.Validator != nil {
+		kinds++
+	}
+	if kinds == 0 {
+		return nil, fmt.Errorf("expected one of index, capped-size/capped-max or validator")
+	}
+	if kinds > 1 {
+		return nil, fmt.Errorf("index, capped-size/capped-max and validator changes must be made separately")
+	}
+
+	cmd := bson.D{{Key: "collMod", Value: collectionName}}
+	switch {
+	case c.Index != nil:
+		if c.Index.Name == "" || c.Index.ExpireAfterSeconds == nil {
+			return nil, fmt.Errorf("index change needs name and expire-after-seconds")
+		}
+		cmd = append(cmd, bson.E{Key: "index", Value: bson.D{
+			{Key: "name", Value: c.Index.Name},
+			{Key: "expireAfterSeconds", Value: *c.Index.ExpireAfterSeconds},
+		}})
+	case c.Validator != nil:
+		validator, err := decodeOrdered(c.Validator)
+		if err != nil {
+			return nil, fmt.Errorf("trouble decoding validator: %w", err)
+		}
+		cmd = append(cmd, bson.E{Key: "validator", Value: validator})
+	default:
+		if c.CappedSize != nil {
+			cmd = append(cmd, bson.E{Key: "cappedSize", Value: *c.CappedSize})
+		}
+		if c.CappedMax != nil {
+			cmd = append(cmd, bson.E{Key: "cappedMax", Value: *c.CappedMax})
+		}
+	}
+	return cmd, nil
+}
+
+func modifyCollection(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			changes        collModChanges
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName, &changes); err != nil {
+			return nil, err
+		}
+
+		cmd, err := changes.command(collectionName)
+		if err != nil {
+			return nil, err
+		}
+
+		//ttl changes report expireAfterSeconds_old and expireAfterSeconds_new
+		var result bson.M
+		if err := client.Database(dbname).RunCommand(ctx, cmd).Decode(&result); err != nil {
+			return nil, fmt.Errorf("collMod failed with: %w", err)
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+// changeStreamPreAndPostImages arrived in MongoDB 6.0
+const preImagesMinVersion = 6
+
+// serverVersion returns the version reported by buildInfo as major, minor and patch
+func serverVersion(ctx context.Context, client *mongo.Client) ([]int32, error) {
+	var info struct {
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info)
+	if err != nil {
+		return nil, fmt.Errorf("buildInfo failed with: %w", err)
+	}
+	if len(info.VersionArray) == 0 {
+		return nil, fmt.Errorf("buildInfo did not report a version")
+	}
+	return info.VersionArray, nil
+}
+
+// serverMajorVersion returns the major version reported by buildInfo
+func serverMajorVersion(ctx context.Context, client *mongo.Client) (int32, error) {
+	version, err := serverVersion(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+	return version[0], nil
+}
+
+// versionAtLeast compares a buildInfo version with want part by part
+func versionAtLeast(version []int32, want ...int32) bool {
+	for i, w := range want {
+		var v int32
+		if i < len(version) {
+			v = version[i]
+		}
+		if v != w {
+			return v > w
+		}
+	}
+	return true
+}
+
+// setPrePostImages toggles the change stream pre and post images of a collection
+func setPrePostImages(client *mongo.Client, enabled bool) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		major, err := serverMajorVersion(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		if major < preImagesMinVersion {
+			return nil, fmt.Errorf("pre and post images need MongoDB %d.0 or newer, server is %d.x", preImagesMinVersion, major)
+		}
+
+		var result bson.M
+		err = client.Database(dbname).RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collectionName},
+			{Key: "changeStreamPreAndPostImages", Value: bson.D{{Key: "enabled", Value: enabled}}},
+		}).Decode(&result)
+		if err != nil {
+			return nil, fmt.Errorf("collMod failed with: %w", err)
+		}
+
+		return json.Marshal(result)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BenchmarkCompress compares plain and gzip results of growing size, the
+// reported bytes/op is what crosses the socket for one call
+func BenchmarkCompress(b *testing.B) {
+	for _, n := range []int{1, 100, 10000} {
+		docs := make([]bson.M, n)
+		for i := range docs {
+			docs[i] = bson.M{"_id": i, "name": fmt.Sprintf("customer %d", i), "tags": []string{"retail", "active"}, "total": float64(i) * 1.5}
+		}
+		payload, err := json.Marshal(docs)
+		if err != nil {
+			b.Fatal(err)
+		}
+		h := withCompression(func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+			return payload, nil
+		})
+
+		for _, compress := range []string{"", "gzip"} {
+			args := []json.RawMessage{json.RawMessage(`{}`)}
+			name := fmt.Sprintf("docs=%d/plain", n)
+			if compress != "" {
+				args = []json.RawMessage{json.RawMessage(`{"compress": "gzip"}`)}
+				name = fmt.Sprintf("docs=%d/gzip", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				var size int
+				for i := 0; i < b.N; i++ {
+					out, err := h(context.Background(), args)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = len(out)
+				}
+				b.ReportMetric(float64(size), "bytes/op")
+			})
+		}
+	}
+}
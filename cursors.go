@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type registeredCursor struct {
+	mu       sync.Mutex
+	cursor   *mongo.Cursor
+	format   string
+	tailable bool
+	//last handed out by get, guarded by the registry lock
+	used time.Time
+}
+
+const (
+	// cursors nobody asked for in this long are closed, the server default cursor timeout
+	cursorIdleTTL = 10 * time.Minute
+	// bounds the find of open-cursor which can't use the call context
+	openCursorTimeout = 30 * time.Second
+)
+
+// cursorRegistry keeps cursors open between cursor-next calls
+type cursorRegistry struct {
+	mu      sync.Mutex
+	cursors map[string]*registeredCursor
+}
+
+var cursors = &cursorRegistry{cursors: make(map[string]*registeredCursor)}
+
+func (r *cursorRegistry) add(c *registeredCursor) string {
+	id := primitive.NewObjectID().Hex()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c.used = time.Now()
+	r.cursors[id] = c
+	r.expire(id, c, cursorIdleTTL)
+	return id
+}
+
+func (r *cursorRegistry) get(id string) (*registeredCursor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.cursors[id]
+	if !ok {
+		return nil, fmt.Errorf("cursor %s not found", id)
+	}
+	c.used = time.Now()
+	return c, nil
+}
+
+func (r *cursorRegistry) remove(id string) (*registeredCursor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.cursors[id]
+	if !ok {
+		return nil, fmt.Errorf("cursor %s not found", id)
+	}
+	delete(r.cursors, id)
+	return c, nil
+}
+
+// expire closes cursor id once it has been idle for cursorIdleTTL,
+// a client that goes away without close-cursor does not keep it open
+func (r *cursorRegistry) expire(id string, c *registeredCursor, after time.Duration) {
+	time.AfterFunc(after, func() {
+		r.mu.Lock()
+		if r.cursors[id] != c {
+			r.mu.Unlock()
+			return
+		}
+		if idle := time.Since(c.used); idle < cursorIdleTTL {
+			r.mu.Unlock()
+			r.expire(id, c, cursorIdleTTL-idle)
+			return
+		}
+		delete(r.cursors, id)
+		r.mu.Unlock()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), openCursorTimeout)
+		defer cancel()
+		c.cursor.Close(ctx)
+	})
+}
+
+// openCursor runs a find and keeps its cursor for cursor-next,
+// "tailable" opens a tailable await cursor on a capped collection
+func openCursor(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := options.Find()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if projection, ok := userOptions["projection"]; ok {
+			opts.SetProjection(projection)
+		}
+		if sort, ok := userOptions["sort"]; ok {
+			opts.SetSort(sort)
+		}
+		if r, ok := intOption(userOptions, "limit"); ok {
+			opts.SetLimit(r)
+		}
+		if r, ok := intOption(userOptions, "batch-size"); ok && r > 0 {
+			opts.SetBatchSize(int32(r))
+		}
+		//bounds the server time of the find and all its getMores together
+		if r, ok := intOption(userOptions, "max-time-ms"); ok && r > 0 {
+			opts.SetMaxTime(time.Duration(r) * time.Millisecond)
+		}
+		tailable, _ := boolOption(userOptions, "tailable")
+		if tailable {
+			opts.SetCursorType(options.TailableAwait)
+		}
+
+		//the cursor outlives this call so it can't be cancelled with the call context
+		findCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), openCursorTimeout)
+		defer cancel()
+		cursor, err := client.Database(dbname).Collection(collectionName).Find(findCtx, filter, opts)
+		if err != nil {
+			return nil, fmt.Errorf("find failed with: %w", err)
+		}
+
+		id := cursors.add(&registeredCursor{cursor: cursor, format: format, tailable: tailable})
+
+		return json.Marshal(map[string]string{"cursor": id})
+	}
+}
+
+type cursorBatch struct {
+	Cursor    string          `json:"cursor"`
+	Documents json.RawMessage `json:"documents"`
+	Exhausted bool            `json:"exhausted"`
+	TimedOut  bool            `json:"timed-out"`
+}
+
+// cursorNext returns the next batch of an open cursor.
+// "max-await-time-ms" and "max-time-ms" are sent as the maxTimeMS of the getMore so the
+// server ends the wait, an empty batch then comes back with timed-out set and the same
+// cursor can be called again. The server only takes a getMore maxTimeMS on tailable
+// cursors so both options need one, other cursors are bounded by max-time-ms on open-cursor.
+func cursorNext() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			id          string
+			userOptions map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &id); err != nil {
+			return nil, err
+		}
+
+		c, err := cursors.get(id)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		var wait int64
+		for _, name := range []string{"max-await-time-ms", "max-time-ms"} {
+			r, ok := intOption(userOptions, name)
+			if !ok {
+				continue
+			}
+			if !c.tailable {
+				return nil, fmt.Errorf("%s needs a tailable cursor, pass max-time-ms to open-cursor instead", name)
+			}
+			if wait == 0 || r < wait {
+				wait = r
+			}
+		}
+		if wait > 0 {
+			c.cursor.SetMaxTime(time.Duration(wait) * time.Millisecond)
+		}
+
+		var hasDoc bool
+		if c.tailable {
+			//TryNext returns after one getMore even when it brought nothing
+			hasDoc = c.cursor.TryNext(ctx)
+		} else {
+			hasDoc = c.cursor.Next(ctx)
+		}
+
+		docs := []bson.M{}
+		for hasDoc {
+			var doc bson.M
+			if err := c.cursor.Decode(&doc); err != nil {
+				return nil, fmt.Errorf("trouble decoding document: %w", err)
+			}
+			docs = append(docs, doc)
+			//stay within the batch already fetched
+			if c.cursor.RemainingBatchLength() == 0 {
+				break
+			}
+			hasDoc = c.cursor.Next(ctx)
+		}
+
+		if err := c.cursor.Err(); err != nil {
+			//a failed getMore leaves the driver cursor unusable
+			cursors.remove(id)
+			c.cursor.Close(context.Background())
+			return nil, fmt.Errorf("cursor %s failed and is closed: %w", id, err)
+		}
+
+		batch := cursorBatch{
+			Cursor:    id,
+			Exhausted: c.cursor.ID() == 0 && c.cursor.RemainingBatchLength() == 0,
+			TimedOut:  c.tailable && len(docs) == 0,
+		}
+		if batch.Exhausted {
+			cursors.remove(id)
+			c.cursor.Close(context.Background())
+			batch.TimedOut = false
+		}
+		if batch.Documents, err = encodeDocs(docs, c.format); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(batch)
+	}
+}
+
+func closeCursor() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var id string
+
+		if err := pod.DecodeArgs(args, &id); err != nil {
+			return nil, err
+		}
+
+		c, err := cursors.remove(id)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := c.cursor.Close(ctx); err != nil {
+			return nil, fmt.Errorf("closing cursor failed with: %w", err)
+		}
+
+		return json.Marshal(map[string]string{"cursor": id})
+	}
+}
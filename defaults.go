@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jlabath/netpod/server/pod"
+)
+
+// readDefaultOptions loads the per handler default options from the json file
+// named by MONGO_DEFAULT_OPTIONS, nil means no defaults
+func readDefaultOptions() (map[string]map[string]interface{}, error) {
+	path := os.Getenv("MONGO_DEFAULT_OPTIONS")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("trouble reading MONGO_DEFAULT_OPTIONS: %w", err)
+	}
+	var defaults map[string]map[string]interface{}
+	if err := json.Unmarshal(b, &defaults); err != nil {
+		return nil, fmt.Errorf("trouble decoding MONGO_DEFAULT_OPTIONS: %w", err)
+	}
+	return defaults, nil
+}
+
+type defaultOptionsKey struct{}
+
+// withDefaultOptions hands defaults to the call through its context, the handler
+// merges them once it has decoded its own options map so they never land in a
+// positional argument whatever the number of arguments given
+func withDefaultOptions(defaults map[string]interface{}, h pod.Handler) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		return h(context.WithValue(ctx, defaultOptionsKey{}, defaults), args)
+	}
+}
+
+// applyDefaultOptions merges the defaults of the call under userOptions,
+// options given by the caller always win
+func applyDefaultOptions(ctx context.Context, userOptions *map[string]interface{}) {
+	defaults, _ := ctx.Value(defaultOptionsKey{}).(map[string]interface{})
+	if len(defaults) == 0 {
+		return
+	}
+	merged := make(map[string]interface{}, len(defaults)+len(*userOptions))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range *userOptions {
+		merged[k] = v
+	}
+	*userOptions = merged
+}
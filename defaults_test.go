@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// TestDefaultOptionsReachDocDiff checks defaults reach doc-diff whether it is
+// called with two documents or five positional arguments, with or without options
+func TestDefaultOptionsReachDocDiff(t *testing.T) {
+	var got map[string]interface{}
+	h := withDefaultOptions(map[string]interface{}{"format": "canonical", "limit": float64(5)},
+		func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+			var userOptions map[string]interface{}
+			if len(args) == 3 || len(args) == 6 {
+				if err := json.Unmarshal(args[len(args)-1], &userOptions); err != nil {
+					return nil, err
+				}
+			}
+			applyDefaultOptions(ctx, &userOptions)
+			got = userOptions
+			return nil, nil
+		})
+
+	docA, docB := json.RawMessage(`{"a": 1}`), json.RawMessage(`{"a": 2}`)
+	ids := []json.RawMessage{json.RawMessage(`"db"`), json.RawMessage(`"a"`), json.RawMessage(`1`), json.RawMessage(`"b"`), json.RawMessage(`2`)}
+	cases := map[string][]json.RawMessage{
+		"documents":              {docA, docB},
+		"documents with options": {docA, docB, json.RawMessage(`{"format": "relaxed"}`)},
+		"ids":                    ids,
+		"ids with options":       append(append([]json.RawMessage{}, ids...), json.RawMessage(`{"format": "relaxed"}`)),
+	}
+	for name, args := range cases {
+		got = nil
+		if _, err := h(context.Background(), args); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got["limit"] != float64(5) {
+			t.Errorf("%s: default limit missing from %v", name, got)
+		}
+		want := "canonical"
+		if len(args) == 3 || len(args) == 6 {
+			want = "relaxed"
+		}
+		if got["format"] != want {
+			t.Errorf("%s: format = %v, want %s", name, got["format"], want)
+		}
+	}
+}
+
+// TestDefaultOptionsLeavePositionalArgs checks a call leaving out its options
+// map gets the defaults without them landing in a positional document
+func TestDefaultOptionsLeavePositionalArgs(t *testing.T) {
+	h := withDefaultOptions(map[string]interface{}{"bypass-document-validation": true},
+		func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+			var (
+				dbname, collectionName string
+				doc, userOptions       map[string]interface{}
+			)
+			if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &doc); err != nil {
+				return nil, err
+			}
+			if _, ok := doc["bypass-document-validation"]; ok {
+				t.Errorf("defaults merged into the document: %v", doc)
+			}
+			if bypass, _ := boolOption(userOptions, "bypass-document-validation"); !bypass {
+				t.Errorf("defaults missing from options: %v", userOptions)
+			}
+			return nil, nil
+		})
+
+	args := []json.RawMessage{json.RawMessage(`"db"`), json.RawMessage(`"coll"`), json.RawMessage(`{"name": "x"}`)}
+	if _, err := h(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+}
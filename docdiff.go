@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type diffResult struct {
+	Added   bson.D
+	Removed bson.D
+	Changed bson.D
+}
+
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// compare records the differences between a and b below path,
+// documents and arrays are walked and other values compared with sameValue
+func (d *diffResult) compare(path string, a, b interface{}) {
+	switch ta := a.(type) {
+	case bson.D:
+		if tb, ok := b.(bson.D); ok {
+			for _, e := range ta {
+				p := joinPath(path, e.Key)
+				if other, ok := lookup(tb, e.Key); ok {
+					d.compare(p, e.Value, other)
+				} else {
+					d.Removed = append(d.Removed, bson.E{Key: p, Value: e.Value})
+				}
+			}
+			for _, e := range tb {
+				if _, ok := lookup(ta, e.Key); !ok {
+					d.Added = append(d.Added, bson.E{Key: joinPath(path, e.Key), Value: e.Value})
+				}
+			}
+			return
+		}
+	case bson.A:
+		if tb, ok := b.(bson.A); ok {
+			for i := 0; i < len(ta) || i < len(tb); i++ {
+				p := joinPath(path, strconv.Itoa(i))
+				switch {
+				case i >= len(tb):
+					d.Removed = append(d.Removed, bson.E{Key: p, Value: ta[i]})
+				case i >= len(ta):
+					d.Added = append(d.Added, bson.E{Key: p, Value: tb[i]})
+				default:
+					d.compare(p, ta[i], tb[i])
+				}
+			}
+			return
+		}
+	}
+	if !sameValue(a, b) {
+		d.Changed = append(d.Changed, bson.E{Key: path, Value: bson.D{
+			{Key: "old", Value: a},
+			{Key: "new", Value: b},
+		}})
+	}
+}
+
+// lookup is docValue telling a missing key from a null value
+func lookup(d bson.D, key string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// readDiffDocument decodes a document argument keeping its key order
+func readDiffDocument(data json.RawMessage, format string) (bson.D, error) {
+	var doc bson.D
+	if format == formatEJSON {
+		if err := bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+			return nil, fmt.Errorf("trouble decoding extended json document: %w", err)
+		}
+		return doc, nil
+	}
+	val, err := decodeOrdered(data)
+	if err != nil {
+		return nil, fmt.Errorf("trouble decoding document: %w", err)
+	}
+	doc, ok := val.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("expected a document but got %s", data)
+	}
+	return doc, nil
+}
+
+// fetchDiffDocument reads the document with the given _id
+func fetchDiffDocument(ctx context.Context, database *mongo.Database, collectionName string, rawID json.RawMessage) (bson.D, error) {
+	id, err := decodeOrdered(rawID)
+	if err != nil {
+		return nil, fmt.Errorf("trouble decoding document id: %w", err)
+	}
+	var doc bson.D
+	err = database.Collection(collectionName).FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s %s failed with: %w", collectionName, rawID, err)
+	}
+	return doc, nil
+}
+
+// docDiff compares two documents passed directly or read by
+// db, collection a, id a, collection b, id b, and returns the added,
+// removed and changed dotted paths
+func docDiff(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			a, b        bson.D
+			userOptions map[string]interface{}
+			err         error
+		)
+
+		//the options map is recognised by the argument count
+		rest := args
+		if len(args) == 3 || len(args) == 6 {
+			if err := json.Unmarshal(args[len(args)-1], &userOptions); err != nil {
+				return nil, err
+			}
+			rest = args[:len(args)-1]
+		}
+		applyDefaultOptions(ctx, &userOptions)
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(rest) {
+		case 2:
+			if a, err = readDiffDocument(rest[0], format); err != nil {
+				return nil, err
+			}
+			if b, err = readDiffDocument(rest[1], format); err != nil {
+				return nil, err
+			}
+		case 5:
+			var dbname, collA, collB string
+			if err := pod.DecodeArgs([]json.RawMessage{rest[0], rest[1], rest[3]}, &dbname, &collA, &collB); err != nil {
+				return nil, err
+			}
+			database := client.Database(dbname)
+			if a, err = fetchDiffDocument(ctx, database, collA, rest[2]); err != nil {
+				return nil, err
+			}
+			if b, err = fetchDiffDocument(ctx, database, collB, rest[4]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("doc-diff takes 2 documents or db, collection, id, collection, id but got %d arguments", len(rest))
+		}
+
+		d := diffResult{Added: bson.D{}, Removed: bson.D{}, Changed: bson.D{}}
+		d.compare("", a, b)
+
+		//round trip through bson so nested values come out as maps
+		result, err := toM(bson.D{
+			{Key: "added", Value: d.Added},
+			{Key: "removed", Value: d.Removed},
+			{Key: "changed", Value: d.Changed},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeDoc(result, format)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// explainFind runs explain with the given verbosity for a find on coll
+func explainFind(ctx context.Context, coll *mongo.Collection, filter bson.D, userOptions map[string]interface{}, verbosity string) (bson.M, error) {
+	find := bson.D{
+		{Key: "find", Value: coll.Name()},
+		{Key: "filter", Value: filter},
+	}
+	if sort, ok := userOptions["sort"]; ok {
+		find = append(find, bson.E{Key: "sort", Value: sort})
+	}
+	hint, hinted, err := hintOption(userOptions)
+	if err != nil {
+		return nil, err
+	}
+	if hinted {
+		find = append(find, bson.E{Key: "hint", Value: hint})
+	}
+	if projection, ok := userOptions["projection"]; ok {
+		find = append(find, bson.E{Key: "projection", Value: projection})
+	}
+	if let, ok := userOptions["let"]; ok {
+		find = append(find, bson.E{Key: "let", Value: convertValue(let)})
+	}
+	if limit, ok := intOption(userOptions, "limit"); ok {
+		find = append(find, bson.E{Key: "limit", Value: limit})
+	}
+
+	var result bson.M
+	err = coll.Database().RunCommand(ctx, bson.D{
+		{Key: "explain", Value: find},
+		{Key: "verbosity", Value: verbosity},
+	}).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("explain failed with: %w", err)
+	}
+	return result, nil
+}
+
+// planHasStage reports whether any stage of an explain plan tree is stage
+func planHasStage(plan interface{}, stage string) bool {
+	switch t := plan.(type) {
+	case bson.M:
+		if t["stage"] == stage {
+			return true
+		}
+		for _, v := range t {
+			if planHasStage(v, stage) {
+				return true
+			}
+		}
+	case bson.A:
+		for _, v := range t {
+			if planHasStage(v, stage) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireIndexedFind rejects a find whose winning plan is a collection scan
+func requireIndexedFind(ctx context.Context, coll *mongo.Collection, filter bson.D, userOptions map[string]interface{}) error {
+	explained, err := explainFind(ctx, coll, filter, userOptions, "queryPlanner")
+	if err != nil {
+		return err
+	}
+	planner, _ := explained["queryPlanner"].(bson.M)
+	if planHasStage(planner["winningPlan"], "COLLSCAN") {
+		return fmt.Errorf("query on %s rejected, it would do a collection scan", coll.Name())
+	}
+	return nil
+}
+
+type filterValidation struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// validateFilter decodes a filter and has the server plan it without reading any documents
+func validateFilter(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter); err != nil {
+			return nil, err
+		}
+
+		invalid := func(err error) (json.RawMessage, error) {
+			return json.Marshal(filterValidation{Valid: false, Error: err.Error()})
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return invalid(err)
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return invalid(err)
+		}
+
+		_, err = explainFind(ctx, client.Database(dbname).Collection(collectionName), filter, userOptions, "queryPlanner")
+		if err != nil {
+			//only the server rejecting the query makes the filter invalid
+			var cmdErr mongo.CommandError
+			if errors.As(err, &cmdErr) {
+				return invalid(err)
+			}
+			return nil, err
+		}
+
+		return json.Marshal(filterValidation{Valid: true})
+	}
+}
+
+type cachedPlan struct {
+	QueryHash        string      `bson:"queryHash" json:"query-hash"`
+	PlanCacheKey     string      `bson:"planCacheKey" json:"plan-cache-key"`
+	IsActive         bool        `bson:"isActive" json:"is-active"`
+	Works            int64       `bson:"works" json:"works"`
+	TimeOfCreation   time.Time   `bson:"timeOfCreation" json:"time-of-creation"`
+	CreatedFromQuery bson.M      `bson:"createdFromQuery" json:"created-from-query"`
+	CachedPlan       interface{} `bson:"cachedPlan" json:"cached-plan"`
+}
+
+// planCache lists the cached query plans of a collection, the "query-hash"
+// option narrows the list to one query shape
+func planCache(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		pipeline := mongo.Pipeline{{{Key: "$planCacheStats", Value: bson.D{}}}}
+		if val, ok := userOptions["query-hash"]; ok {
+			hash, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value for query-hash: %v", val)
+			}
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.D{{Key: "queryHash", Value: hash}}}})
+		}
+
+		cursor, err := client.Database(dbname).Collection(collectionName).Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("$planCacheStats failed with: %w", err)
+		}
+		plans := []cachedPlan{}
+		if err = cursor.All(ctx, &plans); err != nil {
+			return nil, fmt.Errorf("$planCacheStats cursor failed with: %w", err)
+		}
+
+		return json.Marshal(plans)
+	}
+}
+
+func planCacheClear(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		if err := requireEnabled("MONGO_ALLOW_PLAN_CACHE_CLEAR"); err != nil {
+			return nil, err
+		}
+
+		var result bson.M
+		err := client.Database(dbname).RunCommand(ctx, bson.D{
+			{Key: "planCacheClear", Value: collectionName},
+		}).Decode(&result)
+		if err != nil {
+			return nil, fmt.Errorf("planCacheClear failed with: %w", err)
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+const (
+	// server error codes for a hint naming no index or an index that cannot answer the query
+	badValueCode          = 2
+	noQueryExecutionPlans = 291
+)
+
+// hintOption reads the "hint" option which is an index name or a keys map.
+// Options arrive as a go map that does not keep key order, so a keys map can
+// only name one field and compound indexes have to be hinted by name.
+// Hints decoded in order such as the benchmark-query candidates come as bson.D.
+func hintOption(userOptions map[string]interface{}) (interface{}, bool, error) {
+	hint, ok := userOptions["hint"]
+	if !ok {
+		return nil, false, nil
+	}
+	switch t := hint.(type) {
+	case string, bson.D:
+		return hint, true, nil
+	case map[string]interface{}:
+		if len(t) != 1 {
+			return nil, false, fmt.Errorf("a hint keys map must have exactly one field, use the index name for compound indexes: %v", hint)
+		}
+		for k, v := range t {
+			return bson.D{{Key: k, Value: v}}, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("unexpected value for hint, expected an index name or keys: %v", hint)
+}
+
+// hintError replaces the generic wrap of a query the server refused to run with hint
+// by the server error itself, a top level $or is called out since the one hint
+// has to serve every branch. Without a hint err is returned as is.
+func hintError(err error, filter bson.D, hint interface{}) error {
+	var cmdErr mongo.CommandError
+	if hint == nil || !errors.As(err, &cmdErr) || (cmdErr.Code != badValueCode && cmdErr.Code != noQueryExecutionPlans) {
+		return err
+	}
+	if docValue(filter, "$or") != nil {
+		return fmt.Errorf("hint %v cannot be applied to every $or branch: %w", hint, cmdErr)
+	}
+	return fmt.Errorf("hint %v cannot be applied: %w", hint, cmdErr)
+}
+
+// at most this many hints are compared in one benchmark-query call
+const maxBenchmarkCandidates = 10
+
+type benchmarkResult struct {
+	Hint            json.RawMessage `json:"hint"`
+	DocsExamined    int64           `json:"docs-examined"`
+	KeysExamined    int64           `json:"keys-examined"`
+	ExecutionTimeMs int64           `json:"execution-time-ms"`
+	Returned        int64           `json:"returned"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// benchmarkQuery explains a find once per candidate hint with executionStats
+// verbosity so index choices can be compared, explain never modifies data
+func benchmarkQuery(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			hints          []json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &hints); err != nil {
+			return nil, err
+		}
+
+		if len(hints) == 0 || len(hints) > maxBenchmarkCandidates {
+			return nil, fmt.Errorf("benchmark-query takes between 1 and %d hints but got %d", maxBenchmarkCandidates, len(hints))
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		coll := client.Database(dbname).Collection(collectionName)
+		//candidates run one after another so they do not skew each other's timings
+		results := make([]benchmarkResult, len(hints))
+		for i, raw := range hints {
+			results[i].Hint = raw
+
+			//candidates are decoded in order so compound keys keep their order
+			hint, err := decodeOrdered(raw)
+			if err != nil {
+				results[i].Error = fmt.Sprintf("trouble decoding hint: %v", err)
+				continue
+			}
+			candidateOptions := make(map[string]interface{}, len(userOptions)+1)
+			for k, v := range userOptions {
+				candidateOptions[k] = v
+			}
+			candidateOptions["hint"] = hint
+			if _, _, err := hintOption(candidateOptions); err != nil {
+				results[i].Error = err.Error()
+				continue
+			}
+
+			explained, err := explainFind(ctx, coll, filter, candidateOptions, "executionStats")
+			if err != nil {
+				results[i].Error = hintError(err, filter, hint).Error()
+				continue
+			}
+			stats, _ := explained["executionStats"].(bson.M)
+			results[i].DocsExamined = int64(numberValue(stats["totalDocsExamined"]))
+			results[i].KeysExamined = int64(numberValue(stats["totalKeysExamined"]))
+			results[i].ExecutionTimeMs = int64(numberValue(stats["executionTimeMillis"]))
+			results[i].Returned = int64(numberValue(stats["nReturned"]))
+		}
+
+		return json.Marshal(results)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type exportResult struct {
+	Path  string `json:"path"`
+	Count int64  `json:"count"`
+}
+
+// writeNDJSON streams cursor to path one encoded document per line
+func writeNDJSON(ctx context.Context, cursor *mongo.Cursor, path, format string) (int64, error) {
+	defer cursor.Close(ctx)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("trouble creating %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	progress := jobFrom(ctx)
+	var count int64
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return count, fmt.Errorf("trouble decoding document: %w", err)
+		}
+		line, err := encodeDoc(doc, format)
+		if err != nil {
+			return count, err
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return count, fmt.Errorf("trouble writing %s: %w", path, err)
+		}
+		count++
+		progress.advance(1)
+	}
+	if err := cursor.Err(); err != nil {
+		return count, fmt.Errorf("export cursor failed with: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return count, fmt.Errorf("trouble writing %s: %w", path, err)
+	}
+	return count, f.Close()
+}
+
+// exportAggregate writes the results of a pipeline to a file instead of the socket
+func exportAggregate(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawPipeline    json.RawMessage
+			path           string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawPipeline, &path); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		pipeline, err := decodePipeline(rawPipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := options.Aggregate()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if r, ok := boolOption(userOptions, "allow-disk-use"); ok {
+			opts.SetAllowDiskUse(r)
+		}
+
+		cursor, err := client.Database(dbname).Collection(collectionName).Aggregate(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("export-aggregate failed with: %w", err)
+		}
+
+		count, err := writeNDJSON(ctx, cursor, path, format)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(exportResult{Path: path, Count: count})
+	}
+}
+
+// pathValue follows a dotted path through documents and arrays
+func pathValue(v interface{}, path string) interface{} {
+	for _, part := range strings.Split(path, ".") {
+		switch t := v.(type) {
+		case bson.D:
+			v = docValue(t, part)
+		case bson.A:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			v = t[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// csvCell renders a bson value as text, ids as hex, dates as RFC3339
+// and documents or arrays as extended json
+func csvCell(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case primitive.ObjectID:
+		return t.Hex(), nil
+	case primitive.DateTime:
+		return t.Time().UTC().Format(time.RFC3339Nano), nil
+	case bool, int32, int64:
+		return fmt.Sprint(t), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case primitive.Decimal128:
+		return t.String(), nil
+	case bson.D, bson.A:
+		b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: t}}, false, false)
+		if err != nil {
+			return "", err
+		}
+		var wrapper struct {
+			V json.RawMessage `json:"v"`
+		}
+		if err := json.Unmarshal(b, &wrapper); err != nil {
+			return "", err
+		}
+		return string(wrapper.V), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// writeCSV streams cursor to path as csv with one column per field
+func writeCSV(ctx context.Context, cursor *mongo.Cursor, path string, fields []string) (int64, error) {
+	defer cursor.Close(ctx)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("trouble creating %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write(fields); err != nil {
+		return 0, fmt.Errorf("trouble writing %s: %w", path, err)
+	}
+	progress := jobFrom(ctx)
+	var count int64
+	row := make([]string, len(fields))
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return count, fmt.Errorf("trouble decoding document: %w", err)
+		}
+		for i, field := range fields {
+			if row[i], err = csvCell(pathValue(doc, field)); err != nil {
+				return count, err
+			}
+		}
+		if err := w.Write(row); err != nil {
+			return count, fmt.Errorf("trouble writing %s: %w", path, err)
+		}
+		count++
+		progress.advance(1)
+	}
+	if err := cursor.Err(); err != nil {
+		return count, fmt.Errorf("export cursor failed with: %w", err)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return count, fmt.Errorf("trouble writing %s: %w", path, err)
+	}
+	return count, f.Close()
+}
+
+// findCSV writes the selected fields of the documents matching a filter to a csv file,
+// nested fields are selected with dotted paths
+func findCSV(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			fields         []string
+			path           string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &fields, &path); err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("find-csv needs at least one field")
+		}
+
+		coll, err := readCollection(client, dbname, collectionName, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		//project the top level fields, dotted paths may go through arrays
+		projection := bson.D{}
+		projected := map[string]bool{}
+		for _, field := range fields {
+			top := strings.SplitN(field, ".", 2)[0]
+			if !projected[top] {
+				projected[top] = true
+				projection = append(projection, bson.E{Key: top, Value: 1})
+			}
+		}
+		opts := options.Find().SetProjection(projection)
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if sort, ok := userOptions["sort"]; ok {
+			opts.SetSort(sort)
+		}
+		if r, ok := intOption(userOptions, "limit"); ok {
+			opts.SetLimit(r)
+		}
+
+		//knowing the total is only worth a count for background jobs
+		if progress := jobFrom(ctx); progress != nil {
+			if n, err := coll.CountDocuments(ctx, filter); err == nil {
+				progress.setTotal(n)
+			}
+		}
+
+		cursor, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, fmt.Errorf("find-csv failed with: %w", err)
+		}
+
+		count, err := writeCSV(ctx, cursor, path, fields)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(exportResult{Path: path, Count: count})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// layoutRows returns a list of documents
+	layoutRows = "rows"
+	// layoutColumnar returns one list of values per field
+	layoutColumnar = "columnar"
+)
+
+const (
+	// formatTagged is the default encoding via encoding/json
+	formatTagged = "tagged"
+	// formatEJSON is canonical MongoDB Extended JSON v2
+	formatEJSON = "ejson"
+)
+
+// formatOption reads the "format" option, defaulting to tagged.
+// The same format is used to decode the filter, inserted and update documents
+// and to encode results.
+func formatOption(userOptions map[string]interface{}) (string, error) {
+	val, ok := userOptions["format"]
+	if !ok {
+		return formatTagged, nil
+	}
+	if r, ok := val.(string); ok && (r == formatTagged || r == formatEJSON) {
+		return r, nil
+	}
+	return "", fmt.Errorf("unexpected value for format: %v", val)
+}
+
+// layoutOption reads the "layout" option, defaulting to rows
+func layoutOption(userOptions map[string]interface{}) (string, error) {
+	val, ok := userOptions["layout"]
+	if !ok {
+		return layoutRows, nil
+	}
+	if r, ok := val.(string); ok && (r == layoutRows || r == layoutColumnar) {
+		return r, nil
+	}
+	return "", fmt.Errorf("unexpected value for layout: %v", val)
+}
+
+// decodeFilter decodes a filter argument either as a list of
+// filter tuples or as an extended json document.
+// The "raw-values" option keeps {"ObjectId": ...} values as documents so hex
+// looking strings stay strings, other tagged values are still converted.
+func decodeFilter(data json.RawMessage, format string, userOptions map[string]interface{}) (bson.D, error) {
+	if format == formatEJSON {
+		var filter bson.D
+		if err := bson.UnmarshalExtJSON(data, false, &filter); err != nil {
+			return nil, fmt.Errorf("trouble decoding extended json filter: %w", err)
+		}
+		return filter, nil
+	}
+	if rawValues, _ := boolOption(userOptions, "raw-values"); rawValues {
+		var filters rawFilterSlice
+		if err := json.Unmarshal(data, &filters); err != nil {
+			return nil, err
+		}
+		return filters.ToBSOND(), nil
+	}
+	var filters filterSlice
+	if err := json.Unmarshal(data, &filters); err != nil {
+		return nil, err
+	}
+	return filters.ToBSOND(), nil
+}
+
+// decodeValue decodes a document or array argument, as extended json when format is ejson
+// and otherwise with its tagged values converted
+func decodeValue(data json.RawMessage, format string) (interface{}, error) {
+	if format != formatEJSON {
+		return decodeOrdered(data)
+	}
+	//extended json can only unmarshal documents so wrap the value in one
+	wrapped := make([]byte, 0, len(data)+6)
+	wrapped = append(append(append(wrapped, `{"v":`...), data...), '}')
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON(wrapped, false, &doc); err != nil {
+		return nil, err
+	}
+	return docValue(doc, "v"), nil
+}
+
+// decodeRawFilter decodes a base64 encoded BSON document skipping the json filter decoding
+func decodeRawFilter(data json.RawMessage, format string, userOptions map[string]interface{}) (bson.D, error) {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("raw filter must be a base64 string: %w", err)
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("trouble decoding base64 filter: %w", err)
+	}
+	var filter bson.D
+	if err := bson.Unmarshal(b, &filter); err != nil {
+		return nil, fmt.Errorf("trouble decoding bson filter: %w", err)
+	}
+	return filter, nil
+}
+
+func encodeDoc(doc interface{}, format string) (json.RawMessage, error) {
+	if format == formatEJSON {
+		return bson.MarshalExtJSON(doc, true, false)
+	}
+	return json.Marshal(doc)
+}
+
+func encodeDocs(docs []bson.M, format string) (json.RawMessage, error) {
+	if format != formatEJSON {
+		return json.Marshal(docs)
+	}
+	//extended json can only marshal documents so do the array by hand
+	out := make([]json.RawMessage, len(docs))
+	for i, doc := range docs {
+		b, err := encodeDoc(doc, format)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = b
+	}
+	return json.Marshal(out)
+}
+
+// encodeIds encodes just the _id values of docs as a flat array
+func encodeIds(docs []bson.M, format string) (json.RawMessage, error) {
+	ids := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc["_id"]
+	}
+	return encodeValues(ids, format)
+}
+
+// encodeValues encodes a flat array of bson values
+func encodeValues(values []interface{}, format string) (json.RawMessage, error) {
+	if format != formatEJSON {
+		return json.Marshal(values)
+	}
+	//extended json values have to be wrapped in a document to be marshaled
+	b, err := bson.MarshalExtJSON(bson.M{"values": values}, true, false)
+	if err != nil {
+		return nil, err
+	}
+	var wrapper struct {
+		Values json.RawMessage `json:"values"`
+	}
+	if err := json.Unmarshal(b, &wrapper); err != nil {
+		return nil, err
+	}
+	return wrapper.Values, nil
+}
+
+type columns struct {
+	Index   []int                      `json:"index"`
+	Columns map[string]json.RawMessage `json:"columns"`
+}
+
+// encodeColumns transposes docs into one array per top level field, rows
+// missing a field get null so every array lines up with the index
+func encodeColumns(docs []bson.M, format string) (json.RawMessage, error) {
+	values := map[string][]interface{}{}
+	for i, doc := range docs {
+		for field, v := range doc {
+			if _, ok := values[field]; !ok {
+				values[field] = make([]interface{}, len(docs))
+			}
+			values[field][i] = v
+		}
+	}
+
+	result := columns{Index: make([]int, len(docs)), Columns: make(map[string]json.RawMessage, len(values))}
+	for i := range docs {
+		result.Index[i] = i
+	}
+	for field, column := range values {
+		encoded, err := encodeValues(column, format)
+		if err != nil {
+			return nil, err
+		}
+		result.Columns[field] = encoded
+	}
+	return json.Marshal(result)
+}
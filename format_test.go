@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// roundTrip encodes a stored document the way results are encoded and decodes the json back
+func roundTrip(t *testing.T, stored bson.D, format string) map[string]interface{} {
+	t.Helper()
+	b, err := bson.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encodeDocs([]bson.M{doc}, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []map[string]interface{}
+	if err := json.Unmarshal(encoded, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out[0]
+}
+
+func TestEncodeNullAndMissingFields(t *testing.T) {
+	stored := bson.D{
+		{Key: "present", Value: nil},
+		{Key: "nested", Value: bson.D{{Key: "inner", Value: nil}}},
+	}
+	for _, format := range []string{formatTagged, formatEJSON} {
+		doc := roundTrip(t, stored, format)
+
+		if v, ok := doc["present"]; !ok || v != nil {
+			t.Errorf("%s: a stored null should encode as null, got %v (present %v)", format, v, ok)
+		}
+		if _, ok := doc["absent"]; ok {
+			t.Errorf("%s: an absent field should be left out", format)
+		}
+		nested, _ := doc["nested"].(map[string]interface{})
+		if v, ok := nested["inner"]; !ok || v != nil {
+			t.Errorf("%s: a nested null should encode as null, got %v (present %v)", format, v, ok)
+		}
+	}
+}
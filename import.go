@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultImportBatchSize = 1000
+
+// importCheckpoint is kept next to the imported file after every batch so
+// a failed import can carry on from the last inserted line
+type importCheckpoint struct {
+	Database   string `json:"db"`
+	Collection string `json:"collection"`
+	Offset     int64  `json:"offset"`
+	Line       int64  `json:"line"`
+	Inserted   int64  `json:"inserted"`
+}
+
+type importPosition struct {
+	Offset int64 `json:"offset"`
+	Line   int64 `json:"line"`
+}
+
+type importResult struct {
+	Path        string         `json:"path"`
+	ResumedFrom importPosition `json:"resumed-from"`
+	Inserted    int64          `json:"inserted"`
+}
+
+func checkpointPath(path string) string {
+	return path + ".checkpoint"
+}
+
+// writeCheckpoint replaces the checkpoint file in one rename so a crash never leaves half of it
+func writeCheckpoint(path string, cp importCheckpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := checkpointPath(path) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("trouble writing checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, checkpointPath(path)); err != nil {
+		return fmt.Errorf("trouble writing checkpoint: %w", err)
+	}
+	return nil
+}
+
+func readCheckpoint(path string) (importCheckpoint, error) {
+	var cp importCheckpoint
+	b, err := os.ReadFile(checkpointPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, fmt.Errorf("no checkpoint for %s, the import finished or never started", path)
+	}
+	if err != nil {
+		return cp, fmt.Errorf("trouble reading checkpoint: %w", err)
+	}
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return cp, fmt.Errorf("trouble decoding checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+// decodeLine decodes one line of an ndjson file written by export-aggregate
+func decodeLine(line []byte, format string) (bson.D, error) {
+	if format == formatEJSON {
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(line, false, &doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	val, err := decodeOrdered(line)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := val.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("not a document")
+	}
+	return doc, nil
+}
+
+// insertedBefore tells how many documents of a failed ordered insert made it in,
+// known is false when the error leaves that open such as a network error or a timeout
+func insertedBefore(err error) (n int, known bool) {
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && len(bwe.WriteErrors) > 0 && bwe.WriteConcernError == nil {
+		return bwe.WriteErrors[0].Index, true
+	}
+	return 0, false
+}
+
+// importLines inserts the documents of path starting at cp in ordered batches,
+// cp is advanced and saved after each batch including the part of a failed one
+func importLines(ctx context.Context, coll *mongo.Collection, path, format string, cp importCheckpoint, batchSize int) (importCheckpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cp, fmt.Errorf("trouble opening %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(cp.Offset, io.SeekStart); err != nil {
+		return cp, fmt.Errorf("trouble seeking %s: %w", path, err)
+	}
+
+	r := bufio.NewReader(f)
+	progress := jobFrom(ctx)
+	opts := options.InsertMany().SetOrdered(true)
+	if comment, ok := correlationComment(ctx); ok {
+		opts.SetComment(comment)
+	}
+
+	var (
+		docs []interface{}
+		//where the file and line count stand after each document of the batch
+		ends []importPosition
+	)
+	pos := importPosition{Offset: cp.Offset, Line: cp.Line}
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		_, err := coll.InsertMany(ctx, docs, opts)
+		n := len(docs)
+		if err != nil {
+			var known bool
+			if n, known = insertedBefore(err); !known {
+				//the checkpoint stays at the start of the batch, resuming could insert part of it twice
+				first, last := cp.Line+1, ends[len(ends)-1].Line
+				docs, ends = docs[:0], ends[:0]
+				return fmt.Errorf("import failed on lines %d to %d with: %w, some of them may have been inserted, check before resuming", first, last, err)
+			}
+		}
+		if n > 0 {
+			cp.Offset, cp.Line = ends[n-1].Offset, ends[n-1].Line
+			cp.Inserted += int64(n)
+			progress.advance(int64(n))
+			if cerr := writeCheckpoint(path, cp); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		docs, ends = docs[:0], ends[:0]
+		if err != nil {
+			return fmt.Errorf("import failed at line %d with: %w", cp.Line+1, err)
+		}
+		return nil
+	}
+
+	for {
+		line, rerr := r.ReadBytes('\n')
+		if rerr != nil && rerr != io.EOF {
+			return cp, fmt.Errorf("trouble reading %s: %w", path, rerr)
+		}
+		if len(line) > 0 {
+			pos.Offset += int64(len(line))
+			pos.Line++
+			if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+				doc, err := decodeLine(trimmed, format)
+				if err != nil {
+					//keep what the batch has so far before reporting the bad line
+					if ferr := flush(); ferr != nil {
+						return cp, ferr
+					}
+					return cp, fmt.Errorf("trouble decoding line %d: %w", pos.Line, err)
+				}
+				docs = append(docs, doc)
+				ends = append(ends, pos)
+			}
+		}
+		if len(docs) >= batchSize || rerr == io.EOF {
+			if err := flush(); err != nil {
+				return cp, err
+			}
+		}
+		if rerr == io.EOF {
+			return cp, nil
+		}
+	}
+}
+
+// runImport carries on an import from cp, the checkpoint is removed once the whole file is in
+func runImport(ctx context.Context, client *mongo.Client, path string, cp importCheckpoint, userOptions map[string]interface{}) (json.RawMessage, error) {
+	format, err := formatOption(userOptions)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := defaultImportBatchSize
+	if r, ok := intOption(userOptions, "batch-size"); ok && r > 0 {
+		batchSize = int(r)
+	}
+
+	result := importResult{Path: path, ResumedFrom: importPosition{Offset: cp.Offset, Line: cp.Line}}
+	start := cp.Inserted
+	coll := client.Database(cp.Database).Collection(cp.Collection)
+	cp, err = importLines(ctx, coll, path, format, cp, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %d documents inserted, resume-import carries on from line %d", err, cp.Inserted-start, cp.Line+1)
+	}
+	if err := os.Remove(checkpointPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("trouble removing checkpoint: %w", err)
+	}
+
+	result.Inserted = cp.Inserted - start
+	return json.Marshal(result)
+}
+
+// importNDJSON inserts an ndjson file such as the ones export-aggregate writes,
+// progress is checkpointed next to the file for resume-import
+func importNDJSON(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			path           string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &path); err != nil {
+			return nil, err
+		}
+
+		cp := importCheckpoint{Database: dbname, Collection: collectionName}
+		if err := writeCheckpoint(path, cp); err != nil {
+			return nil, err
+		}
+
+		return runImport(ctx, client, path, cp, userOptions)
+	}
+}
+
+// resumeImport continues an import of path from its checkpoint
+func resumeImport(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			path           string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &path); err != nil {
+			return nil, err
+		}
+
+		cp, err := readCheckpoint(path)
+		if err != nil {
+			return nil, err
+		}
+		if cp.Database != dbname || cp.Collection != collectionName {
+			return nil, fmt.Errorf("checkpoint for %s belongs to an import into %s.%s", path, cp.Database, cp.Collection)
+		}
+
+		return runImport(ctx, client, path, cp, userOptions)
+	}
+}
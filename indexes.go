@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexOptionNames maps our option names to the fields of an index spec
+var indexOptionNames = map[string]string{
+	"name":                 "name",
+	"unique":               "unique",
+	"sparse":               "sparse",
+	"expire-after-seconds": "expireAfterSeconds",
+	"partial-filter":       "partialFilterExpression",
+}
+
+// sameValue compares bson values treating all number types alike
+func sameValue(a, b interface{}) bool {
+	switch ta := a.(type) {
+	case int32, int64, float64:
+		switch b.(type) {
+		case int32, int64, float64:
+			return numberValue(a) == numberValue(b)
+		}
+		return false
+	case bson.D:
+		tb, ok := b.(bson.D)
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if ta[i].Key != tb[i].Key || !sameValue(ta[i].Value, tb[i].Value) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// indexMatches reports whether spec has keys and the same value for every
+// option that changes the behaviour of an index, the name does not
+func indexMatches(spec, keys, indexOptions bson.D) bool {
+	if !sameValue(docValue(spec, "key"), keys) {
+		return false
+	}
+	for _, field := range []string{"unique", "sparse", "expireAfterSeconds", "partialFilterExpression"} {
+		want, got := docValue(indexOptions, field), docValue(spec, field)
+		//unique and sparse default to false
+		if want == false {
+			want = nil
+		}
+		if got == false {
+			got = nil
+		}
+		if !sameValue(want, got) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexModel builds the index to create from keys and the spec fields in indexOptions
+func indexModel(keys, indexOptions bson.D) mongo.IndexModel {
+	opts := options.Index()
+	if name, ok := docValue(indexOptions, "name").(string); ok {
+		opts.SetName(name)
+	}
+	if r, ok := docValue(indexOptions, "unique").(bool); ok {
+		opts.SetUnique(r)
+	}
+	if r, ok := docValue(indexOptions, "sparse").(bool); ok {
+		opts.SetSparse(r)
+	}
+	if r := docValue(indexOptions, "expireAfterSeconds"); r != nil {
+		opts.SetExpireAfterSeconds(int32(numberValue(r)))
+	}
+	if r := docValue(indexOptions, "partialFilterExpression"); r != nil {
+		opts.SetPartialFilterExpression(r)
+	}
+	return mongo.IndexModel{Keys: keys, Options: opts}
+}
+
+// decodeIndexOptions reads the options argument of the index handlers keeping
+// the order of the partial filter and renaming the options to spec fields
+func decodeIndexOptions(data json.RawMessage) (bson.D, error) {
+	indexOptions := bson.D{}
+	if data == nil {
+		return indexOptions, nil
+	}
+	val, err := decodeOrdered(data)
+	if err != nil {
+		return nil, fmt.Errorf("trouble decoding index options: %w", err)
+	}
+	d, ok := val.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value for index options: %s", data)
+	}
+	for _, e := range d {
+		if field, ok := indexOptionNames[e.Key]; ok {
+			indexOptions = append(indexOptions, bson.E{Key: field, Value: e.Value})
+		}
+	}
+	return indexOptions, nil
+}
+
+// decodeIndexKeys decodes the ordered keys document of an index
+func decodeIndexKeys(data json.RawMessage) (bson.D, error) {
+	val, err := decodeOrdered(data)
+	if err != nil {
+		return nil, fmt.Errorf("trouble decoding index keys: %w", err)
+	}
+	keys, ok := val.(bson.D)
+	if !ok || len(keys) == 0 {
+		return nil, fmt.Errorf("index keys must be a non empty map: %s", data)
+	}
+	return keys, nil
+}
+
+type ensureIndexResult struct {
+	Name    string `json:"name"`
+	Created bool   `json:"created"`
+}
+
+// ensureIndex creates an index unless one with the same keys and options exists under any name
+func ensureIndex(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawKeys        json.RawMessage
+			rawOptions     json.RawMessage
+		)
+
+		if len(args) == 4 {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &rawKeys, &rawOptions); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &rawKeys); err != nil {
+				return nil, err
+			}
+		}
+
+		keys, err := decodeIndexKeys(rawKeys)
+		if err != nil {
+			return nil, err
+		}
+		indexOptions, err := decodeIndexOptions(rawOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := ensureIndexOn(ctx, client.Database(dbname).Collection(collectionName), keys, indexOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(r)
+	}
+}
+
+// ensureIndexOn creates an index on coll unless an equivalent one exists
+func ensureIndexOn(ctx context.Context, coll *mongo.Collection, keys, indexOptions bson.D) (*ensureIndexResult, error) {
+	specs, err := readIndexSpecs(ctx, coll)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		if indexMatches(spec, keys, indexOptions) {
+			name, _ := docValue(spec, "name").(string)
+			return &ensureIndexResult{Name: name, Created: false}, nil
+		}
+	}
+
+	name, err := coll.Indexes().CreateOne(ctx, indexModel(keys, indexOptions))
+	if err != nil {
+		return nil, fmt.Errorf("createIndex failed with: %w", err)
+	}
+	return &ensureIndexResult{Name: name, Created: true}, nil
+}
+
+type indexSpecEntry struct {
+	Database   string          `json:"db"`
+	Collection string          `json:"collection"`
+	Keys       json.RawMessage `json:"keys"`
+	Options    json.RawMessage `json:"options"`
+}
+
+// ensureIndexSpec ensures the indexes listed in the json file named by MONGO_INDEX_SPEC,
+// the first failure is returned unless MONGO_INDEX_SPEC_IGNORE_ERRORS is set
+func ensureIndexSpec(ctx context.Context, client *mongo.Client) error {
+	path := os.Getenv("MONGO_INDEX_SPEC")
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("trouble reading MONGO_INDEX_SPEC: %w", err)
+	}
+	var entries []indexSpecEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("trouble decoding MONGO_INDEX_SPEC: %w", err)
+	}
+
+	ignoreErrors := envEnabled("MONGO_INDEX_SPEC_IGNORE_ERRORS")
+	for _, entry := range entries {
+		ns := entry.Database + "." + entry.Collection
+		err := func() error {
+			keys, err := decodeIndexKeys(entry.Keys)
+			if err != nil {
+				return err
+			}
+			indexOptions, err := decodeIndexOptions(entry.Options)
+			if err != nil {
+				return err
+			}
+			r, err := ensureIndexOn(ctx, client.Database(entry.Database).Collection(entry.Collection), keys, indexOptions)
+			if err != nil {
+				return err
+			}
+			if r.Created {
+				log.Printf("created index %s on %s", r.Name, ns)
+			} else {
+				log.Printf("index %s on %s already exists", r.Name, ns)
+			}
+			return nil
+		}()
+		if err != nil {
+			if !ignoreErrors {
+				return fmt.Errorf("trouble ensuring index on %s: %w", ns, err)
+			}
+			log.Printf("trouble ensuring index on %s: %v", ns, err)
+		}
+	}
+	return nil
+}
+
+const defaultDuplicateGroups = 100
+
+// findDuplicateGroups returns up to limit groups of documents matching filter and sharing
+// the values of fields. Missing fields group as null the same way a unique index sees them.
+func findDuplicateGroups(ctx context.Context, coll *mongo.Collection, filter bson.D, fields []string, limit int64) ([]bson.M, error) {
+	key := bson.A{}
+	for _, field := range fields {
+		key = append(key, bson.D{{Key: "$ifNull", Value: bson.A{"$" + field, nil}}})
+	}
+	pipeline := mongo.Pipeline{}
+	if len(filter) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: key},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	)
+	cursor, err := coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, fmt.Errorf("duplicate check failed with: %w", err)
+	}
+	var groups []struct {
+		Key   bson.A        `bson:"_id"`
+		Ids   []interface{} `bson:"ids"`
+		Count int64         `bson:"count"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, fmt.Errorf("duplicate check cursor failed with: %w", err)
+	}
+
+	result := make([]bson.M, len(groups))
+	for i, g := range groups {
+		values := bson.M{}
+		for j, field := range fields {
+			values[field] = g.Key[j]
+		}
+		result[i] = bson.M{"key": values, "ids": g.Ids, "count": g.Count}
+	}
+	return result, nil
+}
+
+// fieldList reads a field name or a list of field names
+func fieldList(data json.RawMessage) ([]string, error) {
+	var field string
+	if err := json.Unmarshal(data, &field); err == nil {
+		return []string{field}, nil
+	}
+	var fields []string
+	if err := json.Unmarshal(data, &fields); err != nil || len(fields) == 0 {
+		return nil, fmt.Errorf("expected a field name or a list of field names but got %s", data)
+	}
+	return fields, nil
+}
+
+func findDuplicates(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFields      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFields); err != nil {
+			return nil, err
+		}
+
+		fields, err := fieldList(rawFields)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		limit := int64(defaultDuplicateGroups)
+		if r, ok := intOption(userOptions, "limit"); ok && r > 0 {
+			limit = r
+		}
+
+		groups, err := findDuplicateGroups(ctx, client.Database(dbname).Collection(collectionName), nil, fields, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeDocs(groups, format)
+	}
+}
+
+type uniqueIndexResult struct {
+	Name       string          `json:"name,omitempty"`
+	Created    bool            `json:"created"`
+	Duplicates json.RawMessage `json:"duplicates,omitempty"`
+}
+
+// uniqueIndexFilter narrows the duplicate check to the documents a unique index
+// with indexOptions would hold
+func uniqueIndexFilter(keys, indexOptions bson.D) bson.D {
+	if partial, ok := docValue(indexOptions, "partialFilterExpression").(bson.D); ok {
+		return partial
+	}
+	if sparse, _ := docValue(indexOptions, "sparse").(bool); sparse {
+		//a sparse index skips documents missing every indexed field
+		present := bson.A{}
+		for _, k := range keys {
+			present = append(present, bson.D{{Key: k.Key, Value: bson.D{{Key: "$exists", Value: true}}}})
+		}
+		return bson.D{{Key: "$or", Value: present}}
+	}
+	return nil
+}
+
+// createUniqueIndex creates a unique index only when no documents would violate it,
+// otherwise it returns the duplicate groups that need fixing first
+func createUniqueIndex(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawKeys        json.RawMessage
+			rawOptions     json.RawMessage
+		)
+
+		if len(args) == 4 {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &rawKeys, &rawOptions); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &rawKeys); err != nil {
+				return nil, err
+			}
+		}
+
+		keys, err := decodeIndexKeys(rawKeys)
+		if err != nil {
+			return nil, err
+		}
+		indexOptions, err := decodeIndexOptions(rawOptions)
+		if err != nil {
+			return nil, err
+		}
+		unique := bson.D{{Key: "unique", Value: true}}
+		for _, e := range indexOptions {
+			if e.Key != "unique" {
+				unique = append(unique, e)
+			}
+		}
+		indexOptions = unique
+
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			fields[i] = k.Key
+		}
+
+		coll := client.Database(dbname).Collection(collectionName)
+		groups, err := findDuplicateGroups(ctx, coll, uniqueIndexFilter(keys, indexOptions), fields, defaultDuplicateGroups)
+		if err != nil {
+			return nil, err
+		}
+		if len(groups) > 0 {
+			duplicates, err := encodeDocs(groups, formatTagged)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(uniqueIndexResult{Created: false, Duplicates: duplicates})
+		}
+
+		r, err := ensureIndexOn(ctx, coll, keys, indexOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(uniqueIndexResult{Name: r.Name, Created: r.Created})
+	}
+}
+
+type indexBuild struct {
+	OpID    interface{} `json:"opid"`
+	Indexes []string    `json:"indexes"`
+	Phase   string      `json:"phase"`
+	Done    int64       `json:"done"`
+	Total   int64       `json:"total"`
+	Percent float64     `json:"percent"`
+}
+
+const indexBuildPrefix = "Index Build:"
+
+// buildPhase strips the counters the server appends to an index build message
+// such as "Index Build: scanning collection Index Build: scanning collection: 12/40 30%"
+func buildPhase(msg string) string {
+	if i := strings.Index(msg, indexBuildPrefix); i >= 0 {
+		msg = msg[i+len(indexBuildPrefix):]
+	}
+	if i := strings.Index(msg, " "+indexBuildPrefix); i >= 0 {
+		msg = msg[:i]
+	}
+	return strings.TrimSpace(msg)
+}
+
+// indexBuildProgress reports the index builds running on a collection,
+// the result is empty when none is active
+func indexBuildProgress(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$currentOp", Value: bson.D{{Key: "allUsers", Value: true}}}},
+			{{Key: "$match", Value: bson.D{
+				{Key: "ns", Value: dbname + "." + collectionName},
+				//only the build thread reports a message, the waiting createIndexes op does not
+				{Key: "msg", Value: primitive.Regex{Pattern: "^" + indexBuildPrefix}},
+			}}},
+		}
+		cursor, err := client.Database("admin").Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("$currentOp failed with: %w", err)
+		}
+		var ops []struct {
+			OpID    interface{} `bson:"opid"`
+			Msg     string      `bson:"msg"`
+			Command struct {
+				Indexes []struct {
+					Name string `bson:"name"`
+				} `bson:"indexes"`
+			} `bson:"command"`
+			Progress struct {
+				Done  interface{} `bson:"done"`
+				Total interface{} `bson:"total"`
+			} `bson:"progress"`
+		}
+		if err = cursor.All(ctx, &ops); err != nil {
+			return nil, fmt.Errorf("$currentOp cursor failed with: %w", err)
+		}
+
+		builds := make([]indexBuild, 0, len(ops))
+		for _, op := range ops {
+			build := indexBuild{
+				OpID:    op.OpID,
+				Indexes: []string{},
+				Phase:   buildPhase(op.Msg),
+				Done:    int64(numberValue(op.Progress.Done)),
+				Total:   int64(numberValue(op.Progress.Total)),
+			}
+			for _, index := range op.Command.Indexes {
+				build.Indexes = append(build.Indexes, index.Name)
+			}
+			if build.Total > 0 {
+				build.Percent = float64(build.Done) * 100 / float64(build.Total)
+			}
+			builds = append(builds, build)
+		}
+
+		return json.Marshal(builds)
+	}
+}
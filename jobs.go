@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// job is a handler call running in the background
+type job struct {
+	processed atomic.Int64
+	total     atomic.Int64
+	done      chan struct{}
+	result    json.RawMessage
+	err       error
+}
+
+// finished jobs whose result is never collected are dropped after this long
+const jobResultTTL = 30 * time.Minute
+
+// jobRegistry keeps background jobs until their result is collected
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+var jobs = &jobRegistry{jobs: make(map[string]*job)}
+
+func (r *jobRegistry) add(j *job) string {
+	id := primitive.NewObjectID().Hex()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[id] = j
+	return id
+}
+
+func (r *jobRegistry) get(id string) (*job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j, ok := r.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	return j, nil
+}
+
+func (r *jobRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs, id)
+}
+
+// expire drops job id once jobResultTTL has passed unless job-result collected it already
+func (r *jobRegistry) expire(id string, j *job) {
+	time.AfterFunc(jobResultTTL, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.jobs[id] == j {
+			delete(r.jobs, id)
+		}
+	})
+}
+
+type jobKey struct{}
+
+// jobFrom returns the job a handler runs as, nil when it runs in the foreground
+func jobFrom(ctx context.Context) *job {
+	j, _ := ctx.Value(jobKey{}).(*job)
+	return j
+}
+
+// advance counts processed items, it is a no-op outside of a job
+func (j *job) advance(n int64) {
+	if j != nil {
+		j.processed.Add(n)
+	}
+}
+
+// setTotal records how many items the job expects to process
+func (j *job) setTotal(n int64) {
+	if j != nil {
+		j.total.Store(n)
+	}
+}
+
+// withJobs runs a call in the background when the "background" option is true
+// and returns its job id right away, job-progress and job-result poll it.
+// The job keeps the values of the call such as its correlation id, and with one
+// the cancel handler reaches the job after the call itself has returned.
+func withJobs(h pod.Handler) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var userOptions map[string]interface{}
+		if len(args) > 0 {
+			//the trailing argument is not always an options map
+			_ = json.Unmarshal(args[len(args)-1], &userOptions)
+		}
+		applyDefaultOptions(ctx, &userOptions)
+		if background, _ := boolOption(userOptions, "background"); !background {
+			return h(ctx, args)
+		}
+
+		j := &job{done: make(chan struct{})}
+		id := jobs.add(j)
+
+		//the job outlives the call that started it
+		jobCtx, cancel := context.WithCancel(context.WithValue(context.WithoutCancel(ctx), jobKey{}, j))
+		call := &activeCall{cancel: cancel}
+		correlation, hasCorrelation := correlationComment(ctx)
+		if hasCorrelation {
+			activeCalls.add(correlation, call)
+		}
+
+		go func() {
+			defer jobs.expire(id, j)
+			defer close(j.done)
+			defer cancel()
+			if hasCorrelation {
+				defer activeCalls.remove(correlation, call)
+			}
+			j.result, j.err = h(jobCtx, args)
+		}()
+
+		return json.Marshal(map[string]string{"job": id})
+	}
+}
+
+type jobStatus struct {
+	Job       string `json:"job"`
+	Processed int64  `json:"processed"`
+	Total     int64  `json:"total,omitempty"`
+	Done      bool   `json:"done"`
+}
+
+func jobProgress() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var id string
+
+		if err := pod.DecodeArgs(args, &id); err != nil {
+			return nil, err
+		}
+
+		j, err := jobs.get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		status := jobStatus{Job: id, Processed: j.processed.Load(), Total: j.total.Load()}
+		select {
+		case <-j.done:
+			status.Done = true
+		default:
+		}
+
+		return json.Marshal(status)
+	}
+}
+
+// jobResult returns what the job returned once it is done and forgets the job,
+// results not collected within jobResultTTL of the job finishing are dropped
+func jobResult() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var id string
+
+		if err := pod.DecodeArgs(args, &id); err != nil {
+			return nil, err
+		}
+
+		j, err := jobs.get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-j.done:
+		default:
+			return nil, fmt.Errorf("job %s is still running", id)
+		}
+		jobs.remove(id)
+
+		return j.result, j.err
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultLockTTLMs = 30000
+
+// lockCollections remembers the lock collections whose ttl index was ensured
+var lockCollections sync.Map
+
+// ensureLockIndex makes the server delete expired locks, a lock past its
+// expiry is free to take even before the ttl monitor has removed it
+func ensureLockIndex(ctx context.Context, coll *mongo.Collection) error {
+	ns := coll.Database().Name() + "." + coll.Name()
+	if _, ok := lockCollections.Load(ns); ok {
+		return nil
+	}
+	_, err := ensureIndexOn(ctx, coll,
+		bson.D{{Key: "expiresAt", Value: 1}},
+		bson.D{{Key: "expireAfterSeconds", Value: 0}},
+	)
+	if err != nil {
+		return err
+	}
+	lockCollections.Store(ns, true)
+	return nil
+}
+
+type lockResult struct {
+	Lock      string     `json:"lock"`
+	Owner     string     `json:"owner"`
+	Acquired  bool       `json:"acquired"`
+	ExpiresAt *time.Time `json:"expires-at,omitempty"`
+}
+
+// acquireLock takes the named lock for owner when nobody holds it or it expired,
+// the owner calling again extends its lock by another "ttl-ms"
+func acquireLock(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			name           string
+			owner          string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &name, &owner); err != nil {
+			return nil, err
+		}
+		if owner == "" {
+			return nil, fmt.Errorf("lock owner can't be empty")
+		}
+
+		ttlMs := int64(defaultLockTTLMs)
+		if r, ok := intOption(userOptions, "ttl-ms"); ok && r > 0 {
+			ttlMs = r
+		}
+
+		coll := client.Database(dbname).Collection(collectionName)
+		if err := ensureLockIndex(ctx, coll); err != nil {
+			return nil, err
+		}
+
+		//expiry is computed from the server clock so pods with skewed clocks agree on it
+		filter := bson.D{
+			{Key: "_id", Value: name},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "owner", Value: owner}},
+				bson.D{{Key: "$expr", Value: bson.D{{Key: "$lte", Value: bson.A{"$expiresAt", "$$NOW"}}}}},
+			}},
+		}
+		update := mongo.Pipeline{{{Key: "$set", Value: bson.D{
+			{Key: "owner", Value: bson.D{{Key: "$literal", Value: owner}}},
+			{Key: "expiresAt", Value: bson.D{{Key: "$add", Value: bson.A{"$$NOW", ttlMs}}}},
+		}}}}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+		//when someone else holds the lock the upsert collides with their _id
+		var lock struct {
+			ExpiresAt time.Time `bson:"expiresAt"`
+		}
+		err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&lock)
+		if mongo.IsDuplicateKeyError(err) {
+			return json.Marshal(lockResult{Lock: name, Owner: owner, Acquired: false})
+		}
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fmt.Errorf("acquire-lock failed with: %w", err)
+		}
+
+		expiresAt := lock.ExpiresAt.UTC()
+		return json.Marshal(lockResult{Lock: name, Owner: owner, Acquired: true, ExpiresAt: &expiresAt})
+	}
+}
+
+// releaseLock frees the named lock if owner still holds it
+func releaseLock(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			name           string
+			owner          string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName, &name, &owner); err != nil {
+			return nil, err
+		}
+
+		r, err := client.Database(dbname).Collection(collectionName).DeleteOne(ctx, bson.D{
+			{Key: "_id", Value: name},
+			{Key: "owner", Value: owner},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("release-lock failed with: %w", err)
+		}
+
+		return json.Marshal(map[string]interface{}{
+			"lock":     name,
+			"owner":    owner,
+			"released": r.DeletedCount == 1,
+		})
+	}
+}
@@ -24,6 +24,11 @@ type HexObjID struct {
 type filterTuple bson.E
 
 func (r *filterTuple) UnmarshalJSON(data []byte) error {
+	return r.decode(data, true)
+}
+
+// decode parses a [key value] tuple, coerceOid enables the ObjectId detection
+func (r *filterTuple) decode(data []byte, coerceOid bool) error {
 	var slice []json.RawMessage
 	if err := json.Unmarshal(data, &slice); err != nil {
 		return err
@@ -33,7 +38,6 @@ func (r *filterTuple) UnmarshalJSON(data []byte) error {
 	}
 	var (
 		key   string
-		val   interface{}
 		objId HexObjID
 	)
 	if err := json.Unmarshal(slice[0], &key); err != nil {
@@ -44,25 +48,46 @@ func (r *filterTuple) UnmarshalJSON(data []byte) error {
 	//val could be objective id so try that first
 	//for example
 	//{"ObjectId": "000000000000000000000000"}
-	if err := json.Unmarshal(slice[1], &objId); err == nil {
-		if oid, err := primitive.ObjectIDFromHex(objId.ObjectId); err == nil {
-			//cool it's valid oid
-			r.Value = oid
-			return nil
+	if coerceOid {
+		if err := json.Unmarshal(slice[1], &objId); err == nil {
+			if oid, err := primitive.ObjectIDFromHex(objId.ObjectId); err == nil {
+				//cool it's valid oid
+				r.Value = oid
+				return nil
+			}
 		}
 	}
 
-	//else just do interface{}
-	if err := json.Unmarshal(slice[1], &val); err != nil {
+	//nested values such as {"$expr": {"$gt": ["$a", "$b"]}} or {"$in": [...]}
+	//keep their order and have their tagged values converted at any depth,
+	//without coerceOid ObjectId documents stay as they are
+	val, err := decodeTagged(slice[1], coerceOid)
+	if err != nil {
 		return err
 	}
-
 	r.Value = val
 	return nil
 }
 
 type filterSlice []filterTuple
 
+// rawFilterTuple is a filterTuple without the ObjectId auto detection
+type rawFilterTuple filterTuple
+
+func (r *rawFilterTuple) UnmarshalJSON(data []byte) error {
+	return (*filterTuple)(r).decode(data, false)
+}
+
+type rawFilterSlice []rawFilterTuple
+
+func (r rawFilterSlice) ToBSOND() bson.D {
+	b := make([]bson.E, len(r))
+	for i, item := range r {
+		b[i] = bson.E(item)
+	}
+	return bson.D(b)
+}
+
 func (r filterSlice) ToBSOND() bson.D {
 	a := []filterTuple(r)
 	b := make([]bson.E, len(a))
@@ -72,15 +97,21 @@ func (r filterSlice) ToBSOND() bson.D {
 	return bson.D(b)
 }
 
+// partialResults wraps find-many results when allow-partial-results is set
+type partialResults struct {
+	Documents             json.RawMessage `json:"documents"`
+	PartialResultsAllowed bool            `json:"partial-results-allowed"`
+}
+
 //end of helper types
 
-func checkConnection(client *mongo.Client) bool {
+func checkConnection(client *mongo.Client, uri string) bool {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx, nil); err != nil {
-		log.Println(err.Error())
+		log.Println(redactError(err).Error())
 		return false
 	}
 	return true
@@ -114,38 +145,63 @@ func findOne(client *mongo.Client) pod.Handler {
 		var (
 			dbname         string
 			collectionName string
-			filters        filterSlice
+			rawFilter      json.RawMessage
 			userOptions    map[string]interface{}
 		)
 
 		//we can be called with 3 or 4 arguments
 		if len(args) == 4 {
-			if err := pod.DecodeArgs(args, &dbname, &collectionName, &filters, &userOptions); err != nil {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &rawFilter, &userOptions); err != nil {
 				return nil, err
 			}
 
 		} else {
-			if err := pod.DecodeArgs(args, &dbname, &collectionName, &filters); err != nil {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &rawFilter); err != nil {
 				return nil, err
 			}
 		}
+		applyDefaultOptions(ctx, &userOptions)
 
-		// Define the database to list collections from
-		database := client.Database(dbname)
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		// get collection with the requested read preference
+		coll, err := readCollection(conn, dbname, collectionName, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
 
-		// get collection
-		coll := database.Collection(collectionName)
+		ctx, err = sessionContext(ctx, userOptions)
+		if err != nil {
+			return nil, err
+		}
 
 		//populate options
 		opts := options.FindOne()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
 		if projection, ok := userOptions["projection"]; ok {
 			opts.SetProjection(projection)
 		}
 
 		var result bson.M
-		err := coll.FindOne(
+		err = coll.FindOne(
 			ctx,
-			filters.ToBSOND(),
+			filter,
 			opts,
 		).Decode(&result)
 		if err != nil {
@@ -157,40 +213,77 @@ func findOne(client *mongo.Client) pod.Handler {
 			return nil, fmt.Errorf("findOne failed with: %w", err)
 		}
 
-		return json.Marshal(result)
+		return encodeDoc(result, format)
 	}
 }
 
+// filterDecoder turns the filter argument into a bson document
+type filterDecoder func(data json.RawMessage, format string, userOptions map[string]interface{}) (bson.D, error)
+
 func findMany(client *mongo.Client) pod.Handler {
+	return findManyWith(client, decodeFilter)
+}
+
+func findManyWith(client *mongo.Client, decode filterDecoder) pod.Handler {
 
 	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
 		var (
 			dbname         string
 			collectionName string
-			filters        filterSlice
+			rawFilter      json.RawMessage
 			userOptions    map[string]interface{}
 		)
 
 		//we can be called with 3 or 4 arguments
 		if len(args) == 4 {
-			if err := pod.DecodeArgs(args, &dbname, &collectionName, &filters, &userOptions); err != nil {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &rawFilter, &userOptions); err != nil {
 				return nil, err
 			}
 
 		} else {
-			if err := pod.DecodeArgs(args, &dbname, &collectionName, &filters); err != nil {
+			if err := pod.DecodeArgs(args, &dbname, &collectionName, &rawFilter); err != nil {
 				return nil, err
 			}
 		}
+		applyDefaultOptions(ctx, &userOptions)
 
-		// Define the database to list collections from
-		database := client.Database(dbname)
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
 
-		// get collection
-		coll := database.Collection(collectionName)
+		// get collection with the requested read preference
+		coll, err := readCollection(conn, dbname, collectionName, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		layout, err := layoutOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decode(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, err = sessionContext(ctx, userOptions)
+		if err != nil {
+			return nil, err
+		}
 
 		//populate options
 		opts := options.Find()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
 		if projection, ok := userOptions["projection"]; ok {
 			opts.SetProjection(projection)
 		}
@@ -215,20 +308,102 @@ func findMany(client *mongo.Client) pod.Handler {
 			}
 		}
 
+		//single-batch turns the limit negative so the server returns at most
+		//limit documents in the first batch and closes the cursor right away,
+		//documents that don't fit into that one batch are not returned
+		if r, ok := boolOption(userOptions, "single-batch"); ok && r {
+			if opts.Limit == nil || *opts.Limit == 0 {
+				return nil, errors.New("single-batch requires a limit")
+			}
+			if *opts.Limit > 0 {
+				opts.SetLimit(-*opts.Limit)
+			}
+		}
+
+		//let variables are referenced as $$name in the filter
+		if val, ok := userOptions["let"]; ok {
+			opts.SetLet(convertValue(val))
+		}
+
+		//show-record-id adds the internal $recordId to each document,
+		//record ids are not stable and change when a collection is compacted or resynced
+		if r, ok := boolOption(userOptions, "show-record-id"); ok {
+			opts.SetShowRecordID(r)
+		}
+
+		//require-index defaults to MONGO_REQUIRE_INDEX
+		requireIndex := envEnabled("MONGO_REQUIRE_INDEX")
+		if r, ok := boolOption(userOptions, "require-index"); ok {
+			requireIndex = r
+		}
+		if requireIndex {
+			if err := requireIndexedFind(ctx, coll, filter, userOptions); err != nil {
+				return nil, err
+			}
+		}
+
+		//prefer index names, a keys map loses its order when decoded
+		hint, hinted, err := hintOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+		if hinted {
+			opts.SetHint(hint)
+		}
+
+		//return-key returns only the index keys of the used index,
+		//fields that are not part of that index are absent
+		if r, ok := boolOption(userOptions, "return-key"); ok {
+			opts.SetReturnKey(r)
+		}
+
+		if r, ok := intOption(userOptions, "max-time-ms"); ok {
+			opts.SetMaxTime(time.Duration(r) * time.Millisecond)
+		}
+
+		//only relevant through mongos, shards that fail to respond are left out
+		allowPartial, _ := boolOption(userOptions, "allow-partial-results")
+		if allowPartial {
+			opts.SetAllowPartialResults(true)
+		}
+
+		//ids-only overrides any projection
+		idsOnly, _ := boolOption(userOptions, "ids-only")
+		if idsOnly {
+			opts.SetProjection(bson.D{{Key: "_id", Value: 1}})
+		}
+
 		var results []bson.M
 		if cursor, err := coll.Find(
 			ctx,
-			filters.ToBSOND(),
+			filter,
 			opts,
 		); err != nil {
-			return nil, fmt.Errorf("findMany failed with: %w", err)
+			return nil, hintError(fmt.Errorf("findMany failed with: %w", err), filter, hint)
 		} else {
 			if err = cursor.All(ctx, &results); err != nil {
-				return nil, fmt.Errorf("findMany cursor failed with: %w", err)
+				return nil, hintError(fmt.Errorf("findMany cursor failed with: %w", err), filter, hint)
 			}
 		}
 
-		return json.Marshal(results)
+		var encoded json.RawMessage
+		if idsOnly {
+			encoded, err = encodeIds(results, format)
+		} else if layout == layoutColumnar {
+			encoded, err = encodeColumns(results, format)
+		} else {
+			encoded, err = encodeDocs(results, format)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		//flag the payload since it may be missing documents from some shards
+		if allowPartial {
+			return json.Marshal(partialResults{Documents: encoded, PartialResultsAllowed: true})
+		}
+
+		return encoded, nil
 	}
 }
 
@@ -241,23 +416,72 @@ func main() {
 	// socket file path is first argument given to program
 	socketPath := os.Args[1]
 
+	socketPerms, err := readSocketPermissions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enabled, err := enabledVars()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defaultOptions, err := readDefaultOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	//ctx for mongo client
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	clientOptions := options.Client().ApplyURI(os.Getenv("MONGODB_CONNECTION_URL"))
-	client, err := mongo.Connect(ctx, clientOptions)
+	uri := os.Getenv("MONGODB_CONNECTION_URL")
+	clientOptions := options.Client().ApplyURI(uri).
+		SetServerMonitor(driverEvents.serverMonitor()).
+		SetPoolMonitor(driverEvents.poolMonitor())
+
+	warmUpConnections, err := readWarmUpConnections()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if warmUpConnections > 0 {
+		if err := keepWarm(clientOptions, warmUpConnections); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	proxy, err := readSocksProxy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if proxy != nil {
+		if err := proxy.check(ctx); err != nil {
+			log.Fatal(err)
+		}
+		socksProxy = proxy
+	}
+	applyProxy(clientOptions)
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		//the driver may echo the uri with credentials back
+		log.Fatal(redactError(err))
+	}
 	defer client.Disconnect(ctx)
 
-	if checkConnection(client) {
+	if checkConnection(client, uri) {
 		log.Println("Connected to MongoDB!")
 	} else {
 		os.Exit(1)
 	}
 
+	if warmUpConnections > 0 {
+		warmUp(client, warmUpConnections)
+	}
+
+	if err := ensureIndexSpec(ctx, client); err != nil {
+		log.Fatal(err)
+	}
+
 	ds := pod.DescribeResponse{
 
 		Format: "json",
@@ -268,17 +492,383 @@ func main() {
 				Handler: listCollections(client)},
 				pod.Var{
 					Name:    "find-one",
-					Handler: findOne(client),
+					Handler: withCompression(withResultCache("find-one", withRetries(findOne(client)))),
 				},
 				pod.Var{
 					Name:    "find-many",
-					Handler: findMany(client),
+					Handler: withCompression(withResultCache("find-many", withRetries(findMany(client)))),
+				},
+				pod.Var{
+					Name:    "watch-all",
+					Handler: watchAll(client),
+				},
+				pod.Var{
+					Name:    "start-session",
+					Handler: startSession(client),
+				},
+				pod.Var{
+					Name:    "end-session",
+					Handler: endSession(client),
+				},
+				pod.Var{
+					Name:    "aggregate",
+					Handler: withCompression(aggregate(client)),
+				},
+				pod.Var{
+					Name:    "update-many",
+					Handler: withJobs(withAudit(client, "update-many", updateMany(client))),
+				},
+				pod.Var{
+					Name:    "selectivity",
+					Handler: selectivity(client),
+				},
+				pod.Var{
+					Name:    "next-sequence",
+					Handler: nextSequence(client),
+				},
+				pod.Var{
+					Name:    "wait-for-replication",
+					Handler: waitForReplication(client),
+				},
+				pod.Var{
+					Name:    "sample",
+					Handler: withCompression(sample(client)),
+				},
+				pod.Var{
+					Name:    "insert-one",
+					Handler: withAudit(client, "insert-one", insertOne(client)),
+				},
+				pod.Var{
+					Name:    "insert-many",
+					Handler: withAudit(client, "insert-many", insertMany(client)),
+				},
+				pod.Var{
+					Name:    "list-collections-full",
+					Handler: listCollectionsFull(client),
+				},
+				pod.Var{
+					Name:    "create-view",
+					Handler: createView(client),
+				},
+				pod.Var{
+					Name:    "drop-view",
+					Handler: dropView(client),
+				},
+				pod.Var{
+					Name:    "collection-digest",
+					Handler: collectionDigest(client),
+				},
+				pod.Var{
+					Name:    "cancel",
+					Handler: cancelCall(),
+				},
+				pod.Var{
+					Name:    "oid-timestamp",
+					Handler: oidTimestamp(),
+				},
+				pod.Var{
+					Name:    "oid-from-timestamp",
+					Handler: oidFromTimestamp(),
+				},
+				pod.Var{
+					Name:    "set-field",
+					Handler: withAudit(client, "set-field", setField(client)),
+				},
+				pod.Var{
+					Name:    "unset-field",
+					Handler: withAudit(client, "unset-field", unsetField(client)),
+				},
+				pod.Var{
+					Name:    "rename-field",
+					Handler: withAudit(client, "rename-field", renameField(client)),
+				},
+				pod.Var{
+					Name:    "doc-size-stats",
+					Handler: docSizeStats(client),
+				},
+				pod.Var{
+					Name:    "find-many-raw",
+					Handler: withCompression(withRetries(findManyWith(client, decodeRawFilter))),
+				},
+				pod.Var{
+					Name:    "aggregate-field",
+					Handler: aggregateField(client),
+				},
+				pod.Var{
+					Name:    "compare-schemas",
+					Handler: compareSchemas(client),
+				},
+				pod.Var{
+					Name:    "export-aggregate",
+					Handler: withJobs(exportAggregate(client)),
+				},
+				pod.Var{
+					Name:    "watch",
+					Handler: watchCollection(client),
+				},
+				pod.Var{
+					Name:    "validate-filter",
+					Handler: validateFilter(client),
+				},
+				pod.Var{
+					Name:    "cluster-time",
+					Handler: clusterTime(client),
+				},
+				pod.Var{
+					Name:    "fetch-related",
+					Handler: withCompression(fetchRelated(client)),
+				},
+				pod.Var{
+					Name:    "facet",
+					Handler: withCompression(facet(client)),
+				},
+				pod.Var{
+					Name:    "distinct-across",
+					Handler: distinctAcross(client),
+				},
+				pod.Var{
+					Name:    "apply-patch",
+					Handler: withAudit(client, "apply-patch", applyPatch(client)),
+				},
+				pod.Var{
+					Name:    "count-by-date",
+					Handler: countByDate(client),
+				},
+				pod.Var{
+					Name:    "acquire-lock",
+					Handler: acquireLock(client),
+				},
+				pod.Var{
+					Name:    "release-lock",
+					Handler: releaseLock(client),
+				},
+				pod.Var{
+					Name:    "open-cursor",
+					Handler: openCursor(client),
+				},
+				pod.Var{
+					Name:    "cursor-next",
+					Handler: cursorNext(),
+				},
+				pod.Var{
+					Name:    "close-cursor",
+					Handler: closeCursor(),
+				},
+				pod.Var{
+					Name:    "doc-diff",
+					Handler: docDiff(client),
+				},
+				pod.Var{
+					Name:    "page-by-id",
+					Handler: withCompression(pageByID(client)),
+				},
+				pod.Var{
+					Name:    "field-cardinality",
+					Handler: fieldCardinalityStats(client),
+				},
+				pod.Var{
+					Name:    "find-csv",
+					Handler: withJobs(findCSV(client)),
+				},
+				pod.Var{
+					Name:    "insert-if-absent",
+					Handler: withAudit(client, "insert-if-absent", insertIfAbsent(client)),
+				},
+				pod.Var{
+					Name:    "job-progress",
+					Handler: jobProgress(),
+				},
+				pod.Var{
+					Name:    "job-result",
+					Handler: jobResult(),
+				},
+				pod.Var{
+					Name:    "find-op-by-correlation",
+					Handler: findOpByCorrelation(client),
+				},
+				pod.Var{
+					Name:    "validate-documents",
+					Handler: validateDocuments(),
+				},
+				pod.Var{
+					Name:    "find-duplicates",
+					Handler: findDuplicates(client),
+				},
+				pod.Var{
+					Name:    "apply-retention",
+					Handler: withJobs(withAudit(client, "apply-retention", applyRetention(client))),
+				},
+				pod.Var{
+					Name:    "server-time",
+					Handler: serverTimeHandler(client),
+				},
+				pod.Var{
+					Name:    "multi-find",
+					Handler: withCompression(multiFind(client)),
+				},
+				pod.Var{
+					Name:    "import",
+					Handler: withJobs(withAudit(client, "import", importNDJSON(client))),
+				},
+				pod.Var{
+					Name:    "resume-import",
+					Handler: withJobs(withAudit(client, "resume-import", resumeImport(client))),
 				},
 			}},
+			pod.Namespace{
+				Name: "netpod.jlabath.mongo.admin",
+				Vars: []pod.Var{
+					pod.Var{
+						Name:    "create-user",
+						Handler: createUser(client),
+					},
+					pod.Var{
+						Name:    "drop-user",
+						Handler: dropUser(client),
+					},
+					pod.Var{
+						Name:    "rs-status",
+						Handler: replSetStatus(client),
+					},
+					pod.Var{
+						Name:    "sharding-status",
+						Handler: shardingStatus(client),
+					},
+					pod.Var{
+						Name:    "validate-collection",
+						Handler: validateCollection(client),
+					},
+					pod.Var{
+						Name:    "compact-collection",
+						Handler: compactCollection(client),
+					},
+					pod.Var{
+						Name:    "get-parameter",
+						Handler: getParameter(client),
+					},
+					pod.Var{
+						Name:    "set-parameter",
+						Handler: setParameter(client),
+					},
+					pod.Var{
+						Name:    "repl-info",
+						Handler: replInfo(client),
+					},
+					pod.Var{
+						Name:    "truncate-collection",
+						Handler: truncateCollection(client),
+					},
+					pod.Var{
+						Name:    "reindex-collection",
+						Handler: reindexCollection(client),
+					},
+					pod.Var{
+						Name:    "modify-collection",
+						Handler: modifyCollection(client),
+					},
+					pod.Var{
+						Name:    "wiredtiger-stats",
+						Handler: wiredTigerStats(client),
+					},
+					pod.Var{
+						Name:    "enable-pre-post-images",
+						Handler: setPrePostImages(client, true),
+					},
+					pod.Var{
+						Name:    "disable-pre-post-images",
+						Handler: setPrePostImages(client, false),
+					},
+					pod.Var{
+						Name:    "orphan-check",
+						Handler: orphanCheck(client),
+					},
+					pod.Var{
+						Name:    "topology-events",
+						Handler: topologyEvents(),
+					},
+					pod.Var{
+						Name:    "chunk-distribution",
+						Handler: chunkDistribution(client),
+					},
+					pod.Var{
+						Name:    "balancer-status",
+						Handler: balancerStatus(client),
+					},
+					pod.Var{
+						Name:    "balancer-start",
+						Handler: balancerCommand(client, "balancerStart"),
+					},
+					pod.Var{
+						Name:    "balancer-stop",
+						Handler: balancerCommand(client, "balancerStop"),
+					},
+					pod.Var{
+						Name:    "enable-sharding",
+						Handler: enableSharding(client),
+					},
+					pod.Var{
+						Name:    "shard-collection",
+						Handler: shardCollection(client),
+					},
+				},
+			},
+			pod.Namespace{
+				Name: "netpod.jlabath.mongo.index",
+				Vars: []pod.Var{
+					pod.Var{
+						Name:    "suggest-indexes",
+						Handler: suggestIndexes(client),
+					},
+					pod.Var{
+						Name:    "ensure-index",
+						Handler: ensureIndex(client),
+					},
+					pod.Var{
+						Name:    "plan-cache",
+						Handler: planCache(client),
+					},
+					pod.Var{
+						Name:    "plan-cache-clear",
+						Handler: planCacheClear(client),
+					},
+					pod.Var{
+						Name:    "create-unique-index",
+						Handler: createUniqueIndex(client),
+					},
+					pod.Var{
+						Name:    "index-build-progress",
+						Handler: indexBuildProgress(client),
+					},
+					pod.Var{
+						Name:    "benchmark-query",
+						Handler: benchmarkQuery(client),
+					},
+				},
+			},
 		}}
 
+	//unlisted vars are not described so they do not exist for clients
+	if ds.Namespaces, err = filterVars(ds.Namespaces, enabled); err != nil {
+		log.Fatal(err)
+	}
+
+	//calls with a correlation id can be cancelled by the cancel handler
+	for i := range ds.Namespaces {
+		for j := range ds.Namespaces[i].Vars {
+			v := &ds.Namespaces[i].Vars[j]
+			if defaults, ok := defaultOptions[v.Name]; ok {
+				v.Handler = withDefaultOptions(defaults, v.Handler)
+			}
+			v.Handler = withCorrelation(v.Handler)
+		}
+	}
+
 	os.Remove(socketPath)
 
+	//restrict runs here and sets the umask before pod.Listen creates the socket,
+	//which stays owner only until the goroutine has set its group and mode
+	go socketPerms.restrict(socketPath)()
+
 	//run the server
 	pod.Listen(socketPath, ds)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func decodeTestFilter(t *testing.T, raw string, userOptions map[string]interface{}) bson.D {
+	t.Helper()
+	filter, err := decodeFilter(json.RawMessage(raw), formatTagged, userOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestDecodeFilterExprComparesFields(t *testing.T) {
+	filter := decodeTestFilter(t, `[["$expr", {"$gt": ["$a", "$b"]}]]`, nil)
+	want := bson.D{{Key: "$expr", Value: bson.D{{Key: "$gt", Value: bson.A{"$a", "$b"}}}}}
+	if !reflect.DeepEqual(filter, want) {
+		t.Fatalf("unexpected filter\n got: %#v\nwant: %#v", filter, want)
+	}
+}
+
+func TestDecodeFilterConvertsNestedTaggedValues(t *testing.T) {
+	filter := decodeTestFilter(t, `[
+		["owner", {"$in": [{"ObjectId": "5f1d7f3e9b1e8b3a4c2d1e0f"}]}],
+		["at", {"$gte": {"ISODate": "2024-01-02T03:04:05Z"}, "$lt": "$$NOW"}]
+	]`, nil)
+
+	oid, _ := primitive.ObjectIDFromHex("5f1d7f3e9b1e8b3a4c2d1e0f")
+	at := primitive.NewDateTimeFromTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	want := bson.D{
+		{Key: "owner", Value: bson.D{{Key: "$in", Value: bson.A{oid}}}},
+		{Key: "at", Value: bson.D{{Key: "$gte", Value: at}, {Key: "$lt", Value: "$$NOW"}}},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Fatalf("unexpected filter\n got: %#v\nwant: %#v", filter, want)
+	}
+}
+
+func TestDecodeFilterNullAndMissing(t *testing.T) {
+	filter := decodeTestFilter(t, `[["a", {"$type": "null"}], ["b", {"$exists": false}], ["c", null]]`, nil)
+	want := bson.D{
+		{Key: "a", Value: bson.D{{Key: "$type", Value: "null"}}},
+		{Key: "b", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "c", Value: nil},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Fatalf("unexpected filter\n got: %#v\nwant: %#v", filter, want)
+	}
+}
+
+func TestDecodeFilterRawValuesKeepsObjectIdStrings(t *testing.T) {
+	raw := map[string]interface{}{"raw-values": true}
+	filter := decodeTestFilter(t, `[["_id", {"ObjectId": "000000000000000000000001"}], ["at", {"$gte": {"ISODate": "2024-01-01T00:00:00Z"}}], ["n", {"Int64": "9007199254740993"}]]`, raw)
+	at := primitive.NewDateTimeFromTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	want := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "ObjectId", Value: "000000000000000000000001"}}},
+		{Key: "at", Value: bson.D{{Key: "$gte", Value: at}}},
+		{Key: "n", Value: int64(9007199254740993)},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Fatalf("unexpected filter\n got: %#v\nwant: %#v", filter, want)
+	}
+}
+
+func TestDecodeFilterExprMatchesFieldGreaterThanField(t *testing.T) {
+	filter := decodeTestFilter(t, `[["$expr", {"$gt": ["$spent", "$budget"]}]]`, nil)
+	expr, _ := docValue(filter, "$expr").(bson.D)
+	operands, ok := docValue(expr, "$gt").(bson.A)
+	if !ok || len(operands) != 2 {
+		t.Fatalf("expected a two operand $gt, got %#v", filter)
+	}
+	//evaluate the decoded $expr the way the server would on each document
+	matches := func(doc bson.D) bool {
+		left, _ := evalExpr(t, doc, operands[0]).(int64)
+		right, _ := evalExpr(t, doc, operands[1]).(int64)
+		return left > right
+	}
+
+	docs := []bson.D{
+		{{Key: "_id", Value: int64(1)}, {Key: "spent", Value: int64(120)}, {Key: "budget", Value: int64(100)}},
+		{{Key: "_id", Value: int64(2)}, {Key: "spent", Value: int64(80)}, {Key: "budget", Value: int64(100)}},
+		{{Key: "_id", Value: int64(3)}, {Key: "spent", Value: int64(100)}, {Key: "budget", Value: int64(100)}},
+	}
+	var matched []interface{}
+	for _, doc := range docs {
+		if matches(doc) {
+			matched = append(matched, docValue(doc, "_id"))
+		}
+	}
+	if !reflect.DeepEqual(matched, []interface{}{int64(1)}) {
+		t.Fatalf("expected only the over budget document to match, got %v", matched)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type validateResult struct {
+	Valid    bool     `bson:"valid" json:"valid"`
+	Warnings []string `bson:"warnings" json:"warnings"`
+	Errors   []string `bson:"errors" json:"errors"`
+	Records  int64    `bson:"nrecords" json:"nrecords"`
+	Indexes  int64    `bson:"nIndexes" json:"nindexes"`
+}
+
+func validateCollection(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			full           bool
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName, &full); err != nil {
+			return nil, err
+		}
+
+		//an invalid collection is a normal result so callers can tell it apart from a failed command
+		var result validateResult
+		err := client.Database(dbname).RunCommand(ctx, bson.D{
+			{Key: "validate", Value: collectionName},
+			{Key: "full", Value: full},
+		}).Decode(&result)
+		if err != nil {
+			return nil, fmt.Errorf("validate failed with: %w", err)
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+// withTimeoutOption bounds ctx by the "timeout-ms" option when present
+func withTimeoutOption(ctx context.Context, userOptions map[string]interface{}) (context.Context, context.CancelFunc, int64) {
+	if ms, ok := intOption(userOptions, "timeout-ms"); ok && ms > 0 {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+		return ctx, cancel, ms
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancel, 0
+}
+
+func compactCollection(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			userOptions    map[string]interface{}
+		)
+
+		if err := requireEnabled("MONGO_ALLOW_COMPACT"); err != nil {
+			return nil, err
+		}
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		cmd := bson.D{{Key: "compact", Value: collectionName}}
+		//compact on a replica set primary requires force
+		if force, ok := boolOption(userOptions, "force"); ok {
+			cmd = append(cmd, bson.E{Key: "force", Value: force})
+		}
+
+		//compact blocks so let the caller bound it
+		ctx, cancel, timeoutMs := withTimeoutOption(ctx, userOptions)
+		defer cancel()
+
+		var result bson.M
+		if err := client.Database(dbname).RunCommand(ctx, cmd).Decode(&result); err != nil {
+			if timeoutMs > 0 && mongo.IsTimeout(err) {
+				return nil, fmt.Errorf("compact of %s timed out after %dms", collectionName, timeoutMs)
+			}
+			return nil, fmt.Errorf("compact failed with: %w", err)
+		}
+
+		//result includes bytesFreed when the server reports it
+		return json.Marshal(result)
+	}
+}
+
+// reindexCollection rebuilds all indexes of a collection, only standalone servers allow it
+func reindexCollection(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			userOptions    map[string]interface{}
+		)
+
+		if err := requireEnabled("MONGO_ALLOW_REINDEX"); err != nil {
+			return nil, err
+		}
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		ctx, cancel, timeoutMs := withTimeoutOption(ctx, userOptions)
+		defer cancel()
+
+		var result bson.M
+		err := client.Database(dbname).RunCommand(ctx, bson.D{
+			{Key: "reIndex", Value: collectionName},
+		}).Decode(&result)
+		if err != nil {
+			if timeoutMs > 0 && mongo.IsTimeout(err) {
+				return nil, fmt.Errorf("reIndex of %s timed out after %dms", collectionName, timeoutMs)
+			}
+			return nil, fmt.Errorf("reIndex failed with: %w", err)
+		}
+
+		//result reports nIndexesWas and nIndexes
+		return json.Marshal(result)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// oidTimestamp returns the creation time of an ObjectId given as hex or {"ObjectId": hex}
+func oidTimestamp() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var rawID json.RawMessage
+
+		if err := pod.DecodeArgs(args, &rawID); err != nil {
+			return nil, err
+		}
+
+		val, err := decodeOrdered(rawID)
+		if err != nil {
+			return nil, fmt.Errorf("trouble decoding ObjectId: %w", err)
+		}
+		var oid primitive.ObjectID
+		switch v := val.(type) {
+		case string:
+			if oid, err = primitive.ObjectIDFromHex(v); err != nil {
+				return nil, fmt.Errorf("invalid ObjectId %s: %w", v, err)
+			}
+		case primitive.ObjectID:
+			oid = v
+		default:
+			return nil, fmt.Errorf("invalid ObjectId %s", rawID)
+		}
+
+		//tagged like server-time so it can go straight into a filter
+		return json.Marshal(newTaggedDate(primitive.NewDateTimeFromTime(oid.Timestamp())))
+	}
+}
+
+// oidFromTimestamp returns the smallest ObjectId for a RFC 3339 time or {"ISODate": ...},
+// handy as a bound for _id range queries
+func oidFromTimestamp() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var rawTime json.RawMessage
+
+		if err := pod.DecodeArgs(args, &rawTime); err != nil {
+			return nil, err
+		}
+
+		val, err := decodeOrdered(rawTime)
+		if err != nil {
+			return nil, fmt.Errorf("trouble decoding timestamp: %w", err)
+		}
+		var t time.Time
+		switch v := val.(type) {
+		case string:
+			if t, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("invalid timestamp %s: %w", v, err)
+			}
+		case primitive.DateTime:
+			t = v.Time()
+		default:
+			return nil, fmt.Errorf("invalid timestamp %s", rawTime)
+		}
+
+		return json.Marshal(HexObjID{ObjectId: primitive.NewObjectIDFromTimestamp(t).Hex()})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/jlabath/netpod/server/pod"
+)
+
+// decodeArgsWithOptions decodes args into vals while allowing one extra trailing options map,
+// the MONGO_DEFAULT_OPTIONS of the call are merged into it
+func decodeArgsWithOptions(ctx context.Context, args []json.RawMessage, userOptions *map[string]interface{}, vals ...interface{}) error {
+	var err error
+	if len(args) == len(vals)+1 {
+		err = pod.DecodeArgs(args, append(vals, userOptions)...)
+	} else {
+		err = pod.DecodeArgs(args, vals...)
+	}
+	if err != nil {
+		return err
+	}
+	applyDefaultOptions(ctx, userOptions)
+	return nil
+}
+
+// intOption reads a numeric option, json numbers arrive as float64
+func intOption(userOptions map[string]interface{}, name string) (int64, bool) {
+	val, ok := userOptions[name]
+	if !ok {
+		return 0, false
+	}
+	r, ok := val.(float64)
+	if !ok {
+		log.Printf("unexpected value for %s: %v", name, val)
+		return 0, false
+	}
+	return int64(r), true
+}
+
+func boolOption(userOptions map[string]interface{}, name string) (bool, bool) {
+	val, ok := userOptions[name]
+	if !ok {
+		return false, false
+	}
+	r, ok := val.(bool)
+	if !ok {
+		log.Printf("unexpected value for %s: %v", name, val)
+		return false, false
+	}
+	return r, true
+}
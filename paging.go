@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type idPage struct {
+	Documents json.RawMessage `json:"documents"`
+	NextAfter json.RawMessage `json:"next-after"`
+}
+
+// decodePageID reads the "after" option in the format of the call
+func decodePageID(val interface{}, format string) (interface{}, error) {
+	if format != formatEJSON {
+		return convertValue(val), nil
+	}
+	b, err := json.Marshal(map[string]interface{}{"id": val})
+	if err != nil {
+		return nil, err
+	}
+	var wrapper struct {
+		ID interface{} `bson:"id"`
+	}
+	if err := bson.UnmarshalExtJSON(b, false, &wrapper); err != nil {
+		return nil, fmt.Errorf("trouble decoding after: %w", err)
+	}
+	return wrapper.ID, nil
+}
+
+// encodePageID encodes an _id so it can be passed back as "after"
+func encodePageID(id interface{}, format string) (json.RawMessage, error) {
+	if oid, ok := id.(primitive.ObjectID); ok && format != formatEJSON {
+		return json.Marshal(HexObjID{ObjectId: oid.Hex()})
+	}
+	b, err := encodeValues([]interface{}{id}, format)
+	if err != nil {
+		return nil, err
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, err
+	}
+	return values[0], nil
+}
+
+// pageByID returns the next page of documents sorted by _id after the "after" option,
+// next-after is null once the last page has been read
+func pageByID(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			pageSize       int64
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &pageSize); err != nil {
+			return nil, err
+		}
+		if pageSize <= 0 {
+			return nil, fmt.Errorf("page size must be positive")
+		}
+
+		coll, err := readCollection(client, dbname, collectionName, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := decodeFilter(rawFilter, format, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		if val, ok := userOptions["after"]; ok && val != nil {
+			after, err := decodePageID(val, format)
+			if err != nil {
+				return nil, err
+			}
+			//$and keeps an _id condition of the filter intact
+			filter = bson.D{{Key: "$and", Value: bson.A{
+				filter,
+				bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: after}}}},
+			}}}
+		}
+
+		opts := options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(pageSize)
+		if projection, ok := userOptions["projection"]; ok {
+			opts.SetProjection(projection)
+		}
+
+		cursor, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, fmt.Errorf("page-by-id failed with: %w", err)
+		}
+		docs := []bson.M{}
+		if err = cursor.All(ctx, &docs); err != nil {
+			return nil, fmt.Errorf("page-by-id cursor failed with: %w", err)
+		}
+
+		page := idPage{NextAfter: json.RawMessage("null")}
+		if page.Documents, err = encodeDocs(docs, format); err != nil {
+			return nil, err
+		}
+		//a short page is the last one
+		if int64(len(docs)) == pageSize {
+			if page.NextAfter, err = encodePageID(docs[len(docs)-1]["_id"], format); err != nil {
+				return nil, err
+			}
+		}
+
+		return json.Marshal(page)
+	}
+}
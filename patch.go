@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// pointerPath turns a json pointer such as /a/b~1c/0 into the dotted path a.b/c.0
+func pointerPath(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") || pointer == "/" {
+		return nil, fmt.Errorf("bad json pointer %q", pointer)
+	}
+	segments := strings.Split(pointer[1:], "/")
+	for i, s := range segments {
+		s = strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+		//dots and dollars have a meaning in update paths that a pointer can't express
+		if s == "" || strings.Contains(s, ".") || strings.HasPrefix(s, "$") {
+			return nil, fmt.Errorf("json pointer %q can't be expressed as a field path", pointer)
+		}
+		segments[i] = s
+	}
+	if segments[0] == "_id" {
+		return nil, errors.New("the _id of a document can't be patched")
+	}
+	return segments, nil
+}
+
+// patchUpdate translates add, remove and replace operations into one update document,
+// adding to the end of an array with "-" becomes a $push
+func patchUpdate(ops []patchOp) (bson.D, error) {
+	set, unset, push := bson.D{}, bson.D{}, bson.D{}
+	for _, op := range ops {
+		segments, err := pointerPath(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		last := len(segments) - 1
+		var value interface{}
+		if op.Op != "remove" {
+			if op.Value == nil {
+				return nil, fmt.Errorf("%s %s needs a value", op.Op, op.Path)
+			}
+			if value, err = decodeOrdered(op.Value); err != nil {
+				return nil, fmt.Errorf("trouble decoding value of %s: %w", op.Path, err)
+			}
+		}
+		switch op.Op {
+		case "add":
+			if segments[last] == "-" {
+				if last == 0 {
+					return nil, fmt.Errorf("bad json pointer %q", op.Path)
+				}
+				push = append(push, bson.E{Key: strings.Join(segments[:last], "."), Value: value})
+				continue
+			}
+			set = append(set, bson.E{Key: strings.Join(segments, "."), Value: value})
+		case "replace":
+			set = append(set, bson.E{Key: strings.Join(segments, "."), Value: value})
+		case "remove":
+			unset = append(unset, bson.E{Key: strings.Join(segments, "."), Value: ""})
+		default:
+			return nil, fmt.Errorf("unsupported patch op: %s", op.Op)
+		}
+	}
+
+	update := bson.D{}
+	for _, e := range []bson.E{{Key: "$set", Value: set}, {Key: "$unset", Value: unset}, {Key: "$push", Value: push}} {
+		if len(e.Value.(bson.D)) > 0 {
+			update = append(update, e)
+		}
+	}
+	if len(update) == 0 {
+		return nil, errors.New("patch has no operations")
+	}
+	return update, nil
+}
+
+// applyPatch applies json patch operations to the document with the given _id and returns it updated
+func applyPatch(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawID          json.RawMessage
+			ops            []patchOp
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawID, &ops); err != nil {
+			return nil, err
+		}
+
+		id, err := decodeOrdered(rawID)
+		if err != nil {
+			return nil, fmt.Errorf("trouble decoding document id: %w", err)
+		}
+
+		update, err := patchUpdate(ops)
+		if err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		bypass, err := bypassValidationOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if bypass {
+			opts.SetBypassDocumentValidation(true)
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		var result bson.M
+		err = conn.Database(dbname).Collection(collectionName).FindOneAndUpdate(
+			ctx,
+			bson.D{{Key: "_id", Value: id}},
+			update,
+			opts,
+		).Decode(&result)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("apply-patch failed with: %w", err)
+		}
+
+		return encodeDoc(result, format)
+	}
+}
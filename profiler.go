@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultProfileLimit = 100
+
+var rangeOperators = map[string]bool{
+	"$gt": true, "$gte": true, "$lt": true, "$lte": true, "$ne": true, "$nin": true, "$regex": true, "$exists": true,
+}
+
+type queryShape struct {
+	Equality   []string `json:"equality"`
+	Sort       bson.D   `json:"-"`
+	SortFields []string `json:"sort"`
+	Range      []string `json:"range"`
+}
+
+// addFilterFields sorts the fields of a filter into equality and range buckets
+func (s *queryShape) addFilterFields(filter bson.D) {
+	for _, e := range filter {
+		if e.Key == "$and" {
+			if clauses, ok := e.Value.(bson.A); ok {
+				for _, clause := range clauses {
+					if d, ok := clause.(bson.D); ok {
+						s.addFilterFields(d)
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(e.Key, "$") {
+			//$or, $expr and friends can't be served by one compound index
+			continue
+		}
+		isRange := false
+		if ops, ok := e.Value.(bson.D); ok {
+			for _, op := range ops {
+				if rangeOperators[op.Key] {
+					isRange = true
+				}
+			}
+		}
+		if isRange {
+			s.Range = append(s.Range, e.Key)
+		} else {
+			s.Equality = append(s.Equality, e.Key)
+		}
+	}
+}
+
+// indexKeys applies the equality, sort, range rule to the shape
+func (s *queryShape) indexKeys() bson.D {
+	keys := bson.D{}
+	seen := map[string]bool{}
+	add := func(field string, dir interface{}) {
+		if !seen[field] {
+			seen[field] = true
+			keys = append(keys, bson.E{Key: field, Value: dir})
+		}
+	}
+	for _, f := range s.Equality {
+		add(f, 1)
+	}
+	for _, e := range s.Sort {
+		add(e.Key, e.Value)
+	}
+	for _, f := range s.Range {
+		add(f, 1)
+	}
+	return keys
+}
+
+type indexSuggestion struct {
+	Namespace string          `json:"ns"`
+	Keys      json.RawMessage `json:"keys"`
+	Shapes    []queryShape    `json:"shapes"`
+}
+
+// encodeKeys keeps the order of index keys in the json output
+func encodeKeys(keys bson.D) (json.RawMessage, error) {
+	return bson.MarshalExtJSON(keys, false, false)
+}
+
+// suggestIndexes proposes index keys for recent collection scans recorded by the profiler.
+// It only reads system.profile, nothing is created.
+func suggestIndexes(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname      string
+			userOptions map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname); err != nil {
+			return nil, err
+		}
+
+		limit := int64(defaultProfileLimit)
+		if r, ok := intOption(userOptions, "limit"); ok && r > 0 {
+			limit = r
+		}
+
+		opts := options.Find().
+			SetSort(bson.D{{Key: "ts", Value: -1}}).
+			SetLimit(limit)
+		cursor, err := client.Database(dbname).Collection("system.profile").Find(
+			ctx,
+			bson.D{{Key: "planSummary", Value: "COLLSCAN"}},
+			opts,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("reading system.profile failed with: %w", err)
+		}
+		var entries []struct {
+			Ns      string `bson:"ns"`
+			Command bson.D `bson:"command"`
+		}
+		if err = cursor.All(ctx, &entries); err != nil {
+			return nil, fmt.Errorf("system.profile cursor failed with: %w", err)
+		}
+
+		suggestions := []*indexSuggestion{}
+		byKeys := map[string]*indexSuggestion{}
+		for _, entry := range entries {
+			var shape queryShape
+			if filter, ok := docValue(entry.Command, "filter").(bson.D); ok {
+				shape.addFilterFields(filter)
+			}
+			if sort, ok := docValue(entry.Command, "sort").(bson.D); ok {
+				shape.Sort = sort
+				for _, e := range sort {
+					shape.SortFields = append(shape.SortFields, e.Key)
+				}
+			}
+			keys := shape.indexKeys()
+			if len(keys) == 0 {
+				continue
+			}
+			encoded, err := encodeKeys(keys)
+			if err != nil {
+				return nil, err
+			}
+			id := entry.Ns + string(encoded)
+			if s, ok := byKeys[id]; ok {
+				s.Shapes = append(s.Shapes, shape)
+				continue
+			}
+			s := &indexSuggestion{Namespace: entry.Ns, Keys: encoded, Shapes: []queryShape{shape}}
+			byKeys[id] = s
+			suggestions = append(suggestions, s)
+		}
+
+		return json.Marshal(suggestions)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+// readTagSets reads the "read-tags" option, either one tag set such as
+// {"usage": "analytics"} or a list of them tried in order
+func readTagSets(val interface{}) ([]tag.Set, error) {
+	list, ok := val.([]interface{})
+	if !ok {
+		list = []interface{}{val}
+	}
+	sets := make([]tag.Set, 0, len(list))
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected value for read-tags: %v", val)
+		}
+		set := tag.Set{}
+		for name, v := range m {
+			value, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value for read-tags %s: %v", name, v)
+			}
+			set = append(set, tag.Tag{Name: name, Value: value})
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// readPreferenceOption builds a read preference from the "read-preference",
+// "hedged-read" and "read-tags" options, it returns nil when none is given
+func readPreferenceOption(userOptions map[string]interface{}) (*readpref.ReadPref, error) {
+	mode := readpref.PrimaryMode
+	if val, ok := userOptions["read-preference"]; ok {
+		name, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected value for read-preference: %v", val)
+		}
+		var err error
+		if mode, err = readpref.ModeFromString(name); err != nil {
+			return nil, fmt.Errorf("unexpected value for read-preference: %w", err)
+		}
+	} else if _, ok := userOptions["hedged-read"]; !ok {
+		if _, ok := userOptions["read-tags"]; !ok {
+			return nil, nil
+		}
+	}
+
+	var opts []readpref.Option
+	if hedged, _ := boolOption(userOptions, "hedged-read"); hedged {
+		//hedging sends the read to more than one member so primary makes no sense
+		if mode == readpref.PrimaryMode {
+			return nil, errors.New("hedged-read requires a non-primary read-preference such as nearest")
+		}
+		opts = append(opts, readpref.WithHedgeEnabled(true))
+	}
+	if val, ok := userOptions["read-tags"]; ok {
+		//the primary has no tags to match
+		if mode == readpref.PrimaryMode {
+			return nil, errors.New("read-tags requires a non-primary read-preference such as secondary")
+		}
+		sets, err := readTagSets(val)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, readpref.WithTagSets(sets...))
+	}
+
+	return readpref.New(mode, opts...)
+}
+
+// readCollection returns the collection configured with the requested read preference
+func readCollection(client *mongo.Client, dbname, collectionName string, userOptions map[string]interface{}) (*mongo.Collection, error) {
+	rp, err := readPreferenceOption(userOptions)
+	if err != nil {
+		return nil, err
+	}
+	collOpts := options.Collection()
+	if rp != nil {
+		collOpts.SetReadPreference(rp)
+	}
+	return client.Database(dbname).Collection(collectionName, collOpts), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "xxxxx"
+
+// redactURI removes the password from a connection string so it can be logged.
+// The username is removed as well when MONGO_REDACT_USERNAME is set.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "<unparseable uri>"
+	}
+	if u.User != nil {
+		username := u.User.Username()
+		if envEnabled("MONGO_REDACT_USERNAME") {
+			username = redacted
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(username, redacted)
+		} else {
+			u.User = url.User(username)
+		}
+	}
+	return u.String()
+}
+
+// userinfoPattern matches the userinfo of the connection strings found in a message
+var userinfoPattern = regexp.MustCompile(`(mongodb(?:\+srv)?://)([^/\s"']*)@`)
+
+// redactError scrubs the credentials of every connection string in the message of err,
+// the rest of the message is left alone
+func redactError(err error) error {
+	if err == nil {
+		return err
+	}
+	msg := userinfoPattern.ReplaceAllStringFunc(err.Error(), func(match string) string {
+		parts := userinfoPattern.FindStringSubmatch(match)
+		username, _, hasPassword := strings.Cut(parts[2], ":")
+		if envEnabled("MONGO_REDACT_USERNAME") {
+			username = redacted
+		}
+		if hasPassword {
+			return parts[1] + username + ":" + redacted + "@"
+		}
+		return parts[1] + username + "@"
+	})
+	return errors.New(msg)
+}
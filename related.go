@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultRelatedWorkers = 4
+
+// runBounded calls fn for 0 to n-1 with at most workers calls running at once
+func runBounded(n int, workers int64, fn func(i int)) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, workers)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+type relatedSpec struct {
+	Collection string `json:"collection"`
+	KeyField   string `json:"key-field"`
+}
+
+type relatedResult struct {
+	Documents json.RawMessage `json:"documents,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// fetchRelated finds the documents whose key field equals one value in several
+// collections at once, a failing collection reports its error without failing the call
+func fetchRelated(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname      string
+			rawValue    json.RawMessage
+			specs       []relatedSpec
+			userOptions map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &rawValue, &specs); err != nil {
+			return nil, err
+		}
+
+		value, err := decodeOrdered(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("trouble decoding key value: %w", err)
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]bool, len(specs))
+		for _, spec := range specs {
+			if spec.Collection == "" || spec.KeyField == "" {
+				return nil, fmt.Errorf("related specs need a collection and a key-field: %+v", spec)
+			}
+			if seen[spec.Collection] {
+				return nil, fmt.Errorf("collection %s is listed more than once", spec.Collection)
+			}
+			seen[spec.Collection] = true
+		}
+
+		workers := int64(defaultRelatedWorkers)
+		if r, ok := intOption(userOptions, "workers"); ok && r > 0 {
+			workers = r
+		}
+
+		opts := options.Find()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		database := conn.Database(dbname)
+		fetch := func(spec relatedSpec) relatedResult {
+			cursor, err := database.Collection(spec.Collection).Find(ctx, bson.D{{Key: spec.KeyField, Value: value}}, opts)
+			if err != nil {
+				return relatedResult{Error: fmt.Sprintf("find failed with: %v", err)}
+			}
+			var docs []bson.M
+			if err := cursor.All(ctx, &docs); err != nil {
+				return relatedResult{Error: fmt.Sprintf("find cursor failed with: %v", err)}
+			}
+			if docs == nil {
+				docs = []bson.M{}
+			}
+			encoded, err := encodeDocs(docs, format)
+			if err != nil {
+				return relatedResult{Error: err.Error()}
+			}
+			return relatedResult{Documents: encoded}
+		}
+
+		var mu sync.Mutex
+		results := make(map[string]relatedResult, len(specs))
+		runBounded(len(specs), workers, func(i int) {
+			r := fetch(specs[i])
+			mu.Lock()
+			results[specs[i].Collection] = r
+			mu.Unlock()
+		})
+
+		return json.Marshal(results)
+	}
+}
+
+// distinctKey identifies a distinct value so equal values from different
+// collections are only reported once, numbers compare by value
+func distinctKey(v interface{}) (string, error) {
+	switch v.(type) {
+	case int32, int64, float64:
+		return fmt.Sprintf("n:%v", numberValue(v)), nil
+	}
+	b, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return "", fmt.Errorf("trouble encoding distinct value: %w", err)
+	}
+	return string(b), nil
+}
+
+type distinctAcrossResult struct {
+	Values      json.RawMessage   `json:"values"`
+	Collections []string          `json:"collections"`
+	Errors      map[string]string `json:"errors,omitempty"`
+}
+
+// distinctAcross unions the distinct values of field over all collections matching a glob
+func distinctAcross(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname      string
+			pattern     string
+			field       string
+			userOptions map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &pattern, &field); err != nil {
+			return nil, err
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad collection pattern %s: %w", pattern, err)
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		filter := bson.D{}
+		if val, ok := userOptions["filter"]; ok {
+			b, err := json.Marshal(val)
+			if err != nil {
+				return nil, err
+			}
+			if filter, err = decodeFilter(b, format, userOptions); err != nil {
+				return nil, err
+			}
+		}
+
+		workers := int64(defaultRelatedWorkers)
+		if r, ok := intOption(userOptions, "workers"); ok && r > 0 {
+			workers = r
+		}
+
+		//listCollections is run as a command since its options carry no comment
+		listCmd := bson.D{
+			{Key: "listCollections", Value: 1},
+			{Key: "filter", Value: bson.D{{Key: "type", Value: "collection"}}},
+			{Key: "nameOnly", Value: true},
+		}
+		opts := options.Distinct()
+		if comment, ok := correlationComment(ctx); ok {
+			listCmd = append(listCmd, bson.E{Key: "comment", Value: comment})
+			opts.SetComment(comment)
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		database := conn.Database(dbname)
+		cursor, err := database.RunCommandCursor(ctx, listCmd)
+		if err != nil {
+			return nil, fmt.Errorf("trouble when ListCollections: %w", err)
+		}
+		var names []struct {
+			Name string `bson:"name"`
+		}
+		if err := cursor.All(ctx, &names); err != nil {
+			return nil, fmt.Errorf("listCollections cursor failed with: %w", err)
+		}
+		matched := []string{}
+		for _, n := range names {
+			if ok, _ := path.Match(pattern, n.Name); ok {
+				matched = append(matched, n.Name)
+			}
+		}
+
+		values := make([][]interface{}, len(matched))
+		failures := make([]error, len(matched))
+		runBounded(len(matched), workers, func(i int) {
+			values[i], failures[i] = database.Collection(matched[i]).Distinct(ctx, field, filter, opts)
+		})
+
+		result := distinctAcrossResult{Collections: matched}
+		union := []interface{}{}
+		seen := map[string]bool{}
+		for i, name := range matched {
+			if failures[i] != nil {
+				if result.Errors == nil {
+					result.Errors = map[string]string{}
+				}
+				result.Errors[name] = fmt.Sprintf("distinct failed with: %v", failures[i])
+				continue
+			}
+			for _, v := range values[i] {
+				key, err := distinctKey(v)
+				if err != nil {
+					return nil, err
+				}
+				if !seen[key] {
+					seen[key] = true
+					union = append(union, v)
+				}
+			}
+		}
+
+		if result.Values, err = encodeValues(union, format); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+type findSpec struct {
+	Collection string          `json:"collection"`
+	Filter     json.RawMessage `json:"filter"`
+	Options    json.RawMessage `json:"options"`
+}
+
+// multiFind runs independent find-many queries concurrently and returns their
+// results in the order given, a failed query reports its error in its own slot
+func multiFind(client *mongo.Client) pod.Handler {
+	find := findMany(client)
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname      string
+			specs       []findSpec
+			userOptions map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &specs); err != nil {
+			return nil, err
+		}
+
+		workers := int64(defaultRelatedWorkers)
+		if r, ok := intOption(userOptions, "workers"); ok && r > 0 {
+			workers = r
+		}
+
+		db, err := json.Marshal(dbname)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]relatedResult, len(specs))
+		runBounded(len(specs), workers, func(i int) {
+			spec := specs[i]
+			coll, err := json.Marshal(spec.Collection)
+			if err != nil {
+				results[i] = relatedResult{Error: err.Error()}
+				return
+			}
+			filter := spec.Filter
+			if filter == nil {
+				filter = json.RawMessage("[]")
+			}
+			findArgs := []json.RawMessage{db, coll, filter}
+			if spec.Options != nil {
+				findArgs = append(findArgs, spec.Options)
+			}
+			docs, err := find(ctx, findArgs)
+			if err != nil {
+				results[i] = relatedResult{Error: err.Error()}
+				return
+			}
+			results[i] = relatedResult{Documents: docs}
+		})
+
+		return json.Marshal(results)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// server error code for commands that need a replica set
+const noReplicationEnabled = 76
+
+type rsMember struct {
+	Name     string             `bson:"name" json:"name"`
+	State    int                `bson:"state" json:"state"`
+	StateStr string             `bson:"stateStr" json:"state-str"`
+	Health   float64            `bson:"health" json:"health"`
+	Optime   primitive.DateTime `bson:"optimeDate" json:"-"`
+	//both stay empty for members without an optime such as arbiters or members in STARTUP
+	OptimeDate *taggedDate `bson:"-" json:"optime-date"`
+	LagSeconds *float64    `bson:"-" json:"lag-seconds,omitempty"`
+}
+
+type rsStatus struct {
+	Set        string             `bson:"set" json:"set"`
+	ServerDate primitive.DateTime `bson:"date" json:"-"`
+	Date       taggedDate         `bson:"-" json:"date"`
+	Primary    string             `bson:"-" json:"primary"`
+	Members    []rsMember         `bson:"members" json:"members"`
+}
+
+func isNotReplicaSet(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == noReplicationEnabled
+}
+
+func replSetStatus(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var status rsStatus
+
+		err := client.Database("admin").RunCommand(ctx, bson.D{
+			{Key: "replSetGetStatus", Value: 1},
+		}).Decode(&status)
+		if err != nil {
+			if isNotReplicaSet(err) {
+				return nil, errors.New("server is not a replica set member")
+			}
+			return nil, fmt.Errorf("replSetGetStatus failed with: %w", err)
+		}
+
+		status.Date = newTaggedDate(status.ServerDate)
+
+		//lag is measured against the primary optime, the zero date means there is none
+		var primaryOptime primitive.DateTime
+		for i, m := range status.Members {
+			if m.Optime != 0 {
+				optime := newTaggedDate(m.Optime)
+				status.Members[i].OptimeDate = &optime
+			}
+			if m.StateStr == "PRIMARY" {
+				status.Primary = m.Name
+				primaryOptime = m.Optime
+			}
+		}
+		if primaryOptime != 0 {
+			for i, m := range status.Members {
+				if m.Optime == 0 {
+					continue
+				}
+				lag := primaryOptime.Time().Sub(m.Optime.Time()).Seconds()
+				status.Members[i].LagSeconds = &lag
+			}
+		}
+
+		return json.Marshal(status)
+	}
+}
+
+type oplogInfo struct {
+	First         *taggedTimestamp `json:"first"`
+	Last          *taggedTimestamp `json:"last"`
+	WindowSeconds uint32           `json:"window-seconds"`
+	SizeBytes     int64            `json:"size-bytes"`
+	MaxSizeBytes  int64            `json:"max-size-bytes"`
+}
+
+// oplogEntryTime reads the ts of the oldest (order 1) or newest (order -1) oplog entry
+func oplogEntryTime(ctx context.Context, oplog *mongo.Collection, order int) (primitive.Timestamp, error) {
+	var entry struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}
+	opts := options.FindOne().
+		SetSort(bson.D{{Key: "$natural", Value: order}}).
+		SetProjection(bson.D{{Key: "ts", Value: 1}})
+	if err := oplog.FindOne(ctx, bson.D{}, opts).Decode(&entry); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return entry.TS, errors.New("oplog not accessible, server is likely standalone")
+		}
+		return entry.TS, fmt.Errorf("oplog not accessible: %w", err)
+	}
+	return entry.TS, nil
+}
+
+func replInfo(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var info oplogInfo
+
+		local := client.Database("local")
+		oplog := local.Collection("oplog.rs")
+
+		first, err := oplogEntryTime(ctx, oplog, 1)
+		if err != nil {
+			return nil, err
+		}
+		last, err := oplogEntryTime(ctx, oplog, -1)
+		if err != nil {
+			return nil, err
+		}
+		info.First, info.Last = newTaggedTimestamp(&first), newTaggedTimestamp(&last)
+		info.WindowSeconds = last.T - first.T
+
+		var stats struct {
+			Size    float64 `bson:"size"`
+			MaxSize float64 `bson:"maxSize"`
+		}
+		err = local.RunCommand(ctx, bson.D{
+			{Key: "collStats", Value: "oplog.rs"},
+		}).Decode(&stats)
+		if err != nil {
+			return nil, fmt.Errorf("oplog collStats failed with: %w", err)
+		}
+		info.SizeBytes, info.MaxSizeBytes = int64(stats.Size), int64(stats.MaxSize)
+
+		return json.Marshal(info)
+	}
+}
+
+const (
+	// server error code when a write concern is not met in time
+	writeConcernFailed = 64
+	// collection used for the no-op replication checkpoint write
+	checkpointCollection = "netpod_replication_checkpoint"
+	defaultWTimeoutMs    = 10000
+)
+
+type replicationResult struct {
+	Replicated bool        `json:"replicated"`
+	W          interface{} `json:"w"`
+	WTimeoutMs int64       `json:"wtimeout-ms"`
+}
+
+// waitForOperationTime blocks until the majority committed snapshot reaches ts by reading
+// with afterClusterTime, it reports false when that does not happen within timeout
+func waitForOperationTime(ctx context.Context, client *mongo.Client, dbname string, ts primitive.Timestamp, timeout time.Duration) (bool, error) {
+	sess, err := client.StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		return false, fmt.Errorf("startSession failed with: %w", err)
+	}
+	defer sess.EndSession(ctx)
+	//the session sends its operation time as afterClusterTime with the read concern
+	if err := sess.AdvanceOperationTime(&ts); err != nil {
+		return false, fmt.Errorf("advancing operation time failed with: %w", err)
+	}
+
+	//reading a missing collection creates nothing
+	coll := client.Database(dbname).Collection(
+		checkpointCollection,
+		options.Collection().SetReadConcern(readconcern.Majority()),
+	)
+	err = coll.FindOne(
+		mongo.NewSessionContext(ctx, sess),
+		bson.D{},
+		options.FindOne().SetMaxTime(timeout),
+	).Err()
+	switch {
+	case err == nil, errors.Is(err, mongo.ErrNoDocuments):
+		return true, nil
+	case mongo.IsTimeout(err):
+		return false, nil
+	}
+	return false, fmt.Errorf("replication read failed with: %w", err)
+}
+
+// waitForReplication confirms earlier writes reached the requested write concern.
+// Given an "operation-time" returned by an earlier call and w majority it waits with
+// a majority read after that time and writes nothing. Otherwise it issues a no-op write,
+// upserting one document into the netpod_replication_checkpoint collection of dbname
+// which creates that collection on first use. The oplog applies in order so once this
+// write is acknowledged every earlier write has replicated as well.
+func waitForReplication(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname      string
+			userOptions map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname); err != nil {
+			return nil, err
+		}
+
+		result := replicationResult{W: "majority", WTimeoutMs: defaultWTimeoutMs}
+		if r, ok := intOption(userOptions, "wtimeout-ms"); ok {
+			result.WTimeoutMs = r
+		}
+		wc := writeconcern.Majority()
+		if val, ok := userOptions["w"]; ok {
+			switch t := val.(type) {
+			case string:
+				wc = &writeconcern.WriteConcern{W: t}
+				result.W = t
+			case float64:
+				if t < 0 || t != math.Trunc(t) {
+					return nil, fmt.Errorf("w must be a whole number of members but got %v", t)
+				}
+				wc = &writeconcern.WriteConcern{W: int(t)}
+				result.W = int(t)
+			default:
+				return nil, fmt.Errorf("unexpected value for w: %v", val)
+			}
+		}
+		timeout := time.Duration(result.WTimeoutMs) * time.Millisecond
+		wc.WTimeout = timeout
+
+		if val, ok := userOptions["operation-time"]; ok {
+			ts, ok := convertValue(val).(primitive.Timestamp)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value for operation-time: %v", val)
+			}
+			if result.W != "majority" {
+				return nil, fmt.Errorf("operation-time only works with w majority")
+			}
+			replicated, err := waitForOperationTime(ctx, client, dbname, ts, timeout)
+			if err != nil {
+				return nil, err
+			}
+			result.Replicated = replicated
+			return json.Marshal(result)
+		}
+
+		coll := client.Database(dbname).Collection(
+			checkpointCollection,
+			options.Collection().SetWriteConcern(wc),
+		)
+		_, err := coll.UpdateOne(
+			ctx,
+			bson.D{{Key: "_id", Value: "checkpoint"}},
+			bson.D{{Key: "$currentDate", Value: bson.D{{Key: "at", Value: true}}}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			var we mongo.WriteException
+			if errors.As(err, &we) && we.WriteConcernError != nil && we.WriteConcernError.Code == writeConcernFailed {
+				//not replicated within the timeout
+				return json.Marshal(result)
+			}
+			return nil, fmt.Errorf("replication checkpoint failed with: %w", err)
+		}
+
+		result.Replicated = true
+		return json.Marshal(result)
+	}
+}
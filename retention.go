@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultRetentionBatchSize = 1000
+	defaultRetentionPauseMs   = 100
+)
+
+// parseMaxAge reads a duration such as "90m" or "720h", a "d" suffix counts whole days
+func parseMaxAge(s string) (time.Duration, error) {
+	var (
+		age time.Duration
+		err error
+	)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int64
+		n, err = strconv.ParseInt(days, 10, 64)
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		age, err = time.ParseDuration(s)
+	}
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("unexpected value for max-age: %s", s)
+	}
+	return age, nil
+}
+
+type retentionResult struct {
+	Cutoff  taggedDate `json:"cutoff"`
+	Deleted int64      `json:"deleted"`
+	DryRun  bool       `json:"dry-run"`
+}
+
+// deleteInBatches removes the documents matching filter batchSize at a time
+// pausing between batches so a large expiry does not swamp the server
+func deleteInBatches(ctx context.Context, coll *mongo.Collection, filter bson.D, batchSize int64, pause time.Duration) (int64, error) {
+	var deleted int64
+	progress := jobFrom(ctx)
+	findOpts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}).SetLimit(batchSize)
+	for {
+		cursor, err := coll.Find(ctx, filter, findOpts)
+		if err != nil {
+			return deleted, fmt.Errorf("find failed with: %w", err)
+		}
+		var docs []bson.M
+		if err = cursor.All(ctx, &docs); err != nil {
+			return deleted, fmt.Errorf("find cursor failed with: %w", err)
+		}
+		if len(docs) == 0 {
+			return deleted, nil
+		}
+		ids := make(bson.A, len(docs))
+		for i, doc := range docs {
+			ids[i] = doc["_id"]
+		}
+		r, err := coll.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+		if err != nil {
+			return deleted, fmt.Errorf("deleteMany failed with: %w", err)
+		}
+		deleted += r.DeletedCount
+		progress.advance(r.DeletedCount)
+		if int64(len(docs)) < batchSize {
+			return deleted, nil
+		}
+		select {
+		case <-ctx.Done():
+			return deleted, ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+}
+
+// applyRetention deletes the documents whose date field is older than max-age,
+// the cutoff is taken from the server clock so the pod host clock does not matter
+func applyRetention(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			field          string
+			maxAge         string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &field, &maxAge); err != nil {
+			return nil, err
+		}
+
+		age, err := parseMaxAge(maxAge)
+		if err != nil {
+			return nil, err
+		}
+
+		now, err := serverTime(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		cutoff := now.Add(-age)
+		filter := bson.D{{Key: field, Value: bson.D{{Key: "$lt", Value: cutoff}}}}
+
+		coll := client.Database(dbname).Collection(collectionName)
+		dryRun, _ := boolOption(userOptions, "dry-run")
+		result := retentionResult{Cutoff: newTaggedDate(primitive.NewDateTimeFromTime(cutoff)), DryRun: dryRun}
+
+		if dryRun {
+			if result.Deleted, err = coll.CountDocuments(ctx, filter); err != nil {
+				return nil, fmt.Errorf("countDocuments failed with: %w", err)
+			}
+			return json.Marshal(result)
+		}
+
+		batchSize := int64(defaultRetentionBatchSize)
+		if r, ok := intOption(userOptions, "batch-size"); ok && r > 0 {
+			batchSize = r
+		}
+		pauseMs := int64(defaultRetentionPauseMs)
+		if r, ok := intOption(userOptions, "pause-ms"); ok && r >= 0 {
+			pauseMs = r
+		}
+
+		result.Deleted, err = deleteInBatches(ctx, coll, filter, batchSize, time.Duration(pauseMs)*time.Millisecond)
+		if err != nil {
+			return nil, fmt.Errorf("retention stopped after deleting %d documents: %w", result.Deleted, err)
+		}
+
+		return json.Marshal(result)
+	}
+}
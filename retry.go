@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const maxRetries = 5
+
+// isTransient reports whether err is worth retrying, application errors
+// like no documents or a bad query are not
+func isTransient(err error) bool {
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorLabel("TransientTransactionError")
+}
+
+// withRetries retries a handler on transient errors according to the
+// "retries" and "retry-backoff-ms" options and returns the last error
+func withRetries(h pod.Handler) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var userOptions map[string]interface{}
+		if len(args) > 0 {
+			//the trailing argument is not always an options map
+			_ = json.Unmarshal(args[len(args)-1], &userOptions)
+		}
+		applyDefaultOptions(ctx, &userOptions)
+		retries, _ := intOption(userOptions, "retries")
+		if retries > maxRetries {
+			retries = maxRetries
+		}
+		backoffMs, _ := intOption(userOptions, "retry-backoff-ms")
+
+		for attempt := int64(0); ; attempt++ {
+			value, err := h(ctx, args)
+			if err == nil || attempt >= retries || !isTransient(err) {
+				return value, err
+			}
+			//back off linearly between attempts
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(time.Duration(backoffMs*(attempt+1)) * time.Millisecond):
+			}
+		}
+	}
+}
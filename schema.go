@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bsonTypeMatches reports whether v has the $jsonSchema type name,
+// covering both the bsonType aliases and the json type names
+func bsonTypeMatches(name string, v interface{}) bool {
+	switch name {
+	case "object":
+		_, ok := v.(bson.D)
+		return ok
+	case "array":
+		_, ok := v.(bson.A)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "bool", "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	case "int":
+		_, ok := v.(int32)
+		return ok
+	case "long":
+		_, ok := v.(int64)
+		return ok
+	case "double":
+		_, ok := v.(float64)
+		return ok
+	case "decimal":
+		_, ok := v.(primitive.Decimal128)
+		return ok
+	case "number":
+		switch v.(type) {
+		case int32, int64, float64, primitive.Decimal128:
+			return true
+		}
+	case "date":
+		_, ok := v.(primitive.DateTime)
+		return ok
+	case "objectId":
+		_, ok := v.(primitive.ObjectID)
+		return ok
+	case "timestamp":
+		_, ok := v.(primitive.Timestamp)
+		return ok
+	case "binData":
+		_, ok := v.(primitive.Binary)
+		return ok
+	case "regex":
+		_, ok := v.(primitive.Regex)
+		return ok
+	}
+	return false
+}
+
+// typeNames reads a type keyword given as one name or a list of names
+func typeNames(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case bson.A:
+		names := []string{}
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				names = append(names, s)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// schemaKeywords are the $jsonSchema keywords the server accepts, all of them are checked
+// here except title and description which only annotate the schema
+var schemaKeywords = map[string]bool{
+	"bsonType": true, "type": true, "enum": true, "title": true, "description": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true,
+	"required": true, "properties": true, "patternProperties": true, "additionalProperties": true,
+	"minProperties": true, "maxProperties": true, "dependencies": true,
+	"items": true, "additionalItems": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+}
+
+// schemaValidator checks documents against a $jsonSchema in process. A keyword it does
+// not know is reported as an error so a document is never passed on a guess.
+type schemaValidator struct {
+	errors []string
+}
+
+func (s *schemaValidator) fail(path, format string, a ...interface{}) {
+	if path == "" {
+		path = "$"
+	}
+	s.errors = append(s.errors, path+": "+fmt.Sprintf(format, a...))
+}
+
+// passes checks v against schema on its own and reports whether it had no errors
+func passes(path string, schema bson.D, v interface{}) bool {
+	var sub schemaValidator
+	sub.check(path, schema, v)
+	return len(sub.errors) == 0
+}
+
+// schemaList reads a keyword holding a list of schemas such as anyOf
+func schemaList(v interface{}) []bson.D {
+	list, _ := v.(bson.A)
+	schemas := make([]bson.D, 0, len(list))
+	for _, item := range list {
+		if d, ok := item.(bson.D); ok {
+			schemas = append(schemas, d)
+		}
+	}
+	return schemas
+}
+
+// numericValue returns v as a float64 for the numeric keywords
+func numericValue(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int32, int64, float64:
+		return numberValue(t), true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(t.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (s *schemaValidator) check(path string, schema bson.D, v interface{}) {
+	for _, e := range schema {
+		if !schemaKeywords[e.Key] {
+			s.fail(path, "unsupported $jsonSchema keyword %s", e.Key)
+		}
+	}
+
+	for _, keyword := range []string{"bsonType", "type"} {
+		if names := typeNames(docValue(schema, keyword)); names != nil {
+			matched := false
+			for _, name := range names {
+				if bsonTypeMatches(name, v) {
+					matched = true
+				}
+			}
+			if !matched {
+				s.fail(path, "expected %s %v", keyword, names)
+				//the remaining keywords assume the right type
+				return
+			}
+		}
+	}
+
+	if enum, ok := docValue(schema, "enum").(bson.A); ok {
+		found := false
+		for _, allowed := range enum {
+			if sameValue(allowed, v) {
+				found = true
+			}
+		}
+		if !found {
+			s.fail(path, "value is not one of the enum values")
+		}
+	}
+
+	for _, sub := range schemaList(docValue(schema, "allOf")) {
+		s.check(path, sub, v)
+	}
+	if subs := schemaList(docValue(schema, "anyOf")); len(subs) > 0 {
+		matched := false
+		for _, sub := range subs {
+			if passes(path, sub, v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			s.fail(path, "does not match any of the anyOf schemas")
+		}
+	}
+	if subs := schemaList(docValue(schema, "oneOf")); len(subs) > 0 {
+		matched := 0
+		for _, sub := range subs {
+			if passes(path, sub, v) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			s.fail(path, "matches %d of the oneOf schemas instead of exactly one", matched)
+		}
+	}
+	if not, ok := docValue(schema, "not").(bson.D); ok && passes(path, not, v) {
+		s.fail(path, "matches the not schema")
+	}
+
+	switch t := v.(type) {
+	case bson.D:
+		s.checkObject(path, schema, t)
+	case bson.A:
+		s.checkArray(path, schema, t)
+	case string:
+		n := float64(utf8.RuneCountInString(t))
+		if r := docValue(schema, "minLength"); r != nil && n < numberValue(r) {
+			s.fail(path, "expected at least %v characters", r)
+		}
+		if r := docValue(schema, "maxLength"); r != nil && n > numberValue(r) {
+			s.fail(path, "expected at most %v characters", r)
+		}
+		if pattern, ok := docValue(schema, "pattern").(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				s.fail(path, "bad pattern %s: %v", pattern, err)
+			} else if !re.MatchString(t) {
+				s.fail(path, "does not match pattern %s", pattern)
+			}
+		}
+	default:
+		if n, ok := numericValue(t); ok {
+			s.checkNumber(path, schema, n)
+		}
+	}
+}
+
+func (s *schemaValidator) checkNumber(path string, schema bson.D, n float64) {
+	exclusiveMin, _ := docValue(schema, "exclusiveMinimum").(bool)
+	exclusiveMax, _ := docValue(schema, "exclusiveMaximum").(bool)
+	if r := docValue(schema, "minimum"); r != nil {
+		if min := numberValue(r); n < min || exclusiveMin && n == min {
+			s.fail(path, "expected a minimum of %v", r)
+		}
+	}
+	if r := docValue(schema, "maximum"); r != nil {
+		if max := numberValue(r); n > max || exclusiveMax && n == max {
+			s.fail(path, "expected a maximum of %v", r)
+		}
+	}
+	if r := docValue(schema, "multipleOf"); r != nil {
+		if div := numberValue(r); div > 0 && math.Abs(math.Remainder(n, div)) > 1e-9 {
+			s.fail(path, "expected a multiple of %v", r)
+		}
+	}
+}
+
+func (s *schemaValidator) checkArray(path string, schema bson.D, a bson.A) {
+	if r := docValue(schema, "minItems"); r != nil && float64(len(a)) < numberValue(r) {
+		s.fail(path, "expected at least %v items", r)
+	}
+	if r := docValue(schema, "maxItems"); r != nil && float64(len(a)) > numberValue(r) {
+		s.fail(path, "expected at most %v items", r)
+	}
+	if unique, _ := docValue(schema, "uniqueItems").(bool); unique {
+		for i := range a {
+			for j := i + 1; j < len(a); j++ {
+				if sameValue(a[i], a[j]) {
+					s.fail(joinPath(path, strconv.Itoa(j)), "duplicates item %d", i)
+				}
+			}
+		}
+	}
+	switch items := docValue(schema, "items").(type) {
+	case bson.D:
+		for i, item := range a {
+			s.check(joinPath(path, strconv.Itoa(i)), items, item)
+		}
+	case bson.A:
+		//a list of schemas checks items by position, the rest go to additionalItems
+		tuple := schemaList(items)
+		for i, item := range a {
+			p := joinPath(path, strconv.Itoa(i))
+			if i < len(tuple) {
+				s.check(p, tuple[i], item)
+				continue
+			}
+			switch extra := docValue(schema, "additionalItems").(type) {
+			case bool:
+				if !extra {
+					s.fail(p, "is not an allowed item")
+				}
+			case bson.D:
+				s.check(p, extra, item)
+			}
+		}
+	}
+}
+
+func (s *schemaValidator) checkObject(path string, schema bson.D, doc bson.D) {
+	if required, ok := docValue(schema, "required").(bson.A); ok {
+		for _, name := range required {
+			if field, ok := name.(string); ok {
+				if _, present := lookup(doc, field); !present {
+					s.fail(joinPath(path, field), "is required")
+				}
+			}
+		}
+	}
+	if r := docValue(schema, "minProperties"); r != nil && float64(len(doc)) < numberValue(r) {
+		s.fail(path, "expected at least %v properties", r)
+	}
+	if r := docValue(schema, "maxProperties"); r != nil && float64(len(doc)) > numberValue(r) {
+		s.fail(path, "expected at most %v properties", r)
+	}
+
+	if deps, ok := docValue(schema, "dependencies").(bson.D); ok {
+		for _, dep := range deps {
+			if _, present := lookup(doc, dep.Key); !present {
+				continue
+			}
+			switch t := dep.Value.(type) {
+			case bson.A:
+				for _, name := range t {
+					if field, ok := name.(string); ok {
+						if _, present := lookup(doc, field); !present {
+							s.fail(joinPath(path, field), "is required by %s", dep.Key)
+						}
+					}
+				}
+			case bson.D:
+				s.check(path, t, doc)
+			}
+		}
+	}
+
+	properties, _ := docValue(schema, "properties").(bson.D)
+	patterns, _ := docValue(schema, "patternProperties").(bson.D)
+	for _, e := range doc {
+		p := joinPath(path, e.Key)
+		matched := false
+		if sub, ok := docValue(properties, e.Key).(bson.D); ok {
+			matched = true
+			s.check(p, sub, e.Value)
+		}
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern.Key)
+			if err != nil {
+				s.fail(path, "bad pattern %s: %v", pattern.Key, err)
+				continue
+			}
+			if sub, ok := pattern.Value.(bson.D); ok && re.MatchString(e.Key) {
+				matched = true
+				s.check(p, sub, e.Value)
+			}
+		}
+		if matched {
+			continue
+		}
+		switch extra := docValue(schema, "additionalProperties").(type) {
+		case bool:
+			if !extra {
+				s.fail(p, "is not an allowed property")
+			}
+		case bson.D:
+			s.check(p, extra, e.Value)
+		}
+	}
+}
+
+type documentValidation struct {
+	Index  int      `json:"index"`
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// validateDocuments checks documents against a $jsonSchema without the server,
+// the schema may be given as is or wrapped in {"$jsonSchema": ...}
+func validateDocuments() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			rawSchema json.RawMessage
+			rawDocs   json.RawMessage
+		)
+
+		if err := pod.DecodeArgs(args, &rawSchema, &rawDocs); err != nil {
+			return nil, err
+		}
+
+		val, err := decodeOrdered(rawSchema)
+		if err != nil {
+			return nil, fmt.Errorf("trouble decoding schema: %w", err)
+		}
+		schema, ok := val.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("schema must be a map")
+		}
+		if inner, ok := docValue(schema, "$jsonSchema").(bson.D); ok {
+			schema = inner
+		}
+
+		docs, err := decodeDocuments(rawDocs, formatTagged)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([]documentValidation, len(docs))
+		for i, doc := range docs {
+			var s schemaValidator
+			s.check("", schema, doc)
+			results[i] = documentValidation{Index: i, Valid: len(s.errors) == 0, Errors: s.errors}
+		}
+
+		return json.Marshal(results)
+	}
+}
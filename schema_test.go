@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// schemaErrors checks the json document raw against the json schema and returns the errors
+func schemaErrors(t *testing.T, schema, raw string) []string {
+	t.Helper()
+	s, err := decodeOrdered([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := decodeOrdered([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v schemaValidator
+	v.check("", s.(bson.D), doc)
+	return v.errors
+}
+
+func TestSchemaUnsupportedKeywordFails(t *testing.T) {
+	errs := schemaErrors(t, `{"bsonType":"object","if":{"required":["a"]}}`, `{"a":1}`)
+	if len(errs) != 1 || !strings.Contains(errs[0], "unsupported $jsonSchema keyword if") {
+		t.Fatalf("expected the unsupported keyword to be reported, got %v", errs)
+	}
+}
+
+func TestSchemaKeywords(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		valid  string
+		bad    string
+	}{
+		{"anyOf", `{"anyOf":[{"bsonType":"string"},{"bsonType":"int"}]}`, `"x"`, `true`},
+		{"oneOf", `{"oneOf":[{"minimum":0},{"maximum":10}]}`, `20`, `5`},
+		{"allOf", `{"allOf":[{"minimum":0},{"maximum":10}]}`, `5`, `20`},
+		{"not", `{"not":{"bsonType":"string"}}`, `1`, `"x"`},
+		{"additionalProperties schema", `{"properties":{"a":{}},"additionalProperties":{"bsonType":"string"}}`, `{"a":1,"b":"x"}`, `{"a":1,"b":2}`},
+		{"patternProperties", `{"patternProperties":{"^n_":{"bsonType":"string"}},"additionalProperties":false}`, `{"n_a":"x"}`, `{"n_a":1}`},
+		{"dependencies", `{"dependencies":{"card":["billing"]}}`, `{"card":1,"billing":2}`, `{"card":1}`},
+		{"uniqueItems", `{"uniqueItems":true}`, `[1,2,3]`, `[1,2,1]`},
+		{"items tuple", `{"items":[{"bsonType":"string"}],"additionalItems":false}`, `["x"]`, `["x",1]`},
+		{"exclusiveMinimum", `{"minimum":0,"exclusiveMinimum":true}`, `1`, `0`},
+		{"multipleOf", `{"multipleOf":5}`, `15`, `16`},
+		{"maxProperties", `{"maxProperties":1}`, `{"a":1}`, `{"a":1,"b":2}`},
+	}
+	for _, c := range cases {
+		if errs := schemaErrors(t, c.schema, c.valid); len(errs) > 0 {
+			t.Errorf("%s: expected %s to pass, got %v", c.name, c.valid, errs)
+		}
+		if errs := schemaErrors(t, c.schema, c.bad); len(errs) == 0 {
+			t.Errorf("%s: expected %s to fail", c.name, c.bad)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sessions nobody used in this long are ended, the server default session timeout
+const sessionIdleTTL = 30 * time.Minute
+
+type registeredSession struct {
+	sess mongo.Session
+	used time.Time
+}
+
+// sessionRegistry keeps sessions alive between handler calls.
+// A mongo.Session is not goroutine safe so callers should not
+// run concurrent operations on the same session.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*registeredSession
+}
+
+var sessions = &sessionRegistry{sessions: make(map[string]*registeredSession)}
+
+func (r *sessionRegistry) add(sess mongo.Session) string {
+	id := primitive.NewObjectID().Hex()
+	s := &registeredSession{sess: sess, used: time.Now()}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[id] = s
+	r.expire(id, s, sessionIdleTTL)
+	return id
+}
+
+func (r *sessionRegistry) get(id string) (mongo.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session %s not found", id)
+	}
+	s.used = time.Now()
+	return s.sess, nil
+}
+
+func (r *sessionRegistry) remove(id string) (mongo.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session %s not found", id)
+	}
+	delete(r.sessions, id)
+	return s.sess, nil
+}
+
+// expire ends session id once it has been idle for sessionIdleTTL,
+// a client that goes away without end-session does not keep it alive
+func (r *sessionRegistry) expire(id string, s *registeredSession, after time.Duration) {
+	time.AfterFunc(after, func() {
+		r.mu.Lock()
+		if r.sessions[id] != s {
+			r.mu.Unlock()
+			return
+		}
+		if idle := time.Since(s.used); idle < sessionIdleTTL {
+			r.mu.Unlock()
+			r.expire(id, s, sessionIdleTTL-idle)
+			return
+		}
+		delete(r.sessions, id)
+		r.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.sess.EndSession(ctx)
+	})
+}
+
+// sessionContext binds ctx to the session named by the "session" option.
+// Operations sharing a causally consistent session observe their own prior writes.
+func sessionContext(ctx context.Context, userOptions map[string]interface{}) (context.Context, error) {
+	val, ok := userOptions["session"]
+	if !ok {
+		return ctx, nil
+	}
+	id, ok := val.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value for session: %v", val)
+	}
+	sess, err := sessions.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return mongo.NewSessionContext(ctx, sess), nil
+}
+
+// sessionInfo carries the operation time in the form cluster-time accepts back,
+// a fresh session has none so start-session leaves it out
+type sessionInfo struct {
+	Session       string           `json:"session"`
+	OperationTime *taggedTimestamp `json:"operation-time,omitempty"`
+}
+
+func startSession(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var userOptions map[string]interface{}
+
+		if len(args) == 1 {
+			if err := pod.DecodeArgs(args, &userOptions); err != nil {
+				return nil, err
+			}
+		}
+		applyDefaultOptions(ctx, &userOptions)
+
+		opts := options.Session()
+		if r, ok := boolOption(userOptions, "causal-consistency"); ok {
+			opts.SetCausalConsistency(r)
+		}
+
+		sess, err := client.StartSession(opts)
+		if err != nil {
+			return nil, fmt.Errorf("startSession failed with: %w", err)
+		}
+
+		return json.Marshal(sessionInfo{Session: sessions.add(sess)})
+	}
+}
+
+func endSession(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var id string
+
+		if err := pod.DecodeArgs(args, &id); err != nil {
+			return nil, err
+		}
+
+		sess, err := sessions.remove(id)
+		if err != nil {
+			return nil, err
+		}
+		//report the last operation time so clients can order later reads
+		info := sessionInfo{Session: id, OperationTime: newTaggedTimestamp(sess.OperationTime())}
+		sess.EndSession(ctx)
+
+		return json.Marshal(info)
+	}
+}
+
+type clusterTimeInfo struct {
+	Session       string           `json:"session"`
+	ClusterTime   json.RawMessage  `json:"cluster-time"`
+	OperationTime *taggedTimestamp `json:"operation-time"`
+}
+
+// clusterTime reports the cluster and operation time of a session and can advance them
+// to times observed by another process, giving read your writes across pods
+func clusterTime(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			id          string
+			userOptions map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &id); err != nil {
+			return nil, err
+		}
+
+		sess, err := sessions.get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		//cluster-time is the value returned by an earlier call
+		if val, ok := userOptions["cluster-time"]; ok {
+			b, err := json.Marshal(val)
+			if err != nil {
+				return nil, err
+			}
+			var ct bson.Raw
+			if err := bson.UnmarshalExtJSON(b, true, &ct); err != nil {
+				return nil, fmt.Errorf("trouble decoding cluster-time: %w", err)
+			}
+			if err := sess.AdvanceClusterTime(ct); err != nil {
+				return nil, fmt.Errorf("advancing cluster time failed with: %w", err)
+			}
+		}
+		if val, ok := userOptions["operation-time"]; ok {
+			ts, ok := convertValue(val).(primitive.Timestamp)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value for operation-time: %v", val)
+			}
+			if err := sess.AdvanceOperationTime(&ts); err != nil {
+				return nil, fmt.Errorf("advancing operation time failed with: %w", err)
+			}
+		}
+
+		info := clusterTimeInfo{
+			Session:       id,
+			ClusterTime:   json.RawMessage("null"),
+			OperationTime: newTaggedTimestamp(sess.OperationTime()),
+		}
+		if ct := sess.ClusterTime(); ct != nil {
+			info.ClusterTime, err = bson.MarshalExtJSON(ct, true, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return json.Marshal(info)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errNotSharded = errors.New("not a sharded cluster, connect through mongos")
+
+// isMongos reports whether client is connected to a mongos router
+func isMongos(ctx context.Context, client *mongo.Client) (bool, error) {
+	var hello struct {
+		Msg string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "hello", Value: 1},
+	}).Decode(&hello)
+	if err != nil {
+		return false, fmt.Errorf("hello failed with: %w", err)
+	}
+	//mongos identifies itself with this message
+	return hello.Msg == "isdbgrid", nil
+}
+
+// requireMongos returns errNotSharded unless connected through mongos
+func requireMongos(ctx context.Context, client *mongo.Client) error {
+	ok, err := isMongos(ctx, client)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNotSharded
+	}
+	return nil
+}
+
+func findAllConfig(ctx context.Context, client *mongo.Client, collectionName string) ([]bson.M, error) {
+	results := []bson.M{}
+	cursor, err := client.Database("config").Collection(collectionName).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("reading config.%s failed with: %w", collectionName, err)
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("config.%s cursor failed with: %w", collectionName, err)
+	}
+	return results, nil
+}
+
+func shardingStatus(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+
+		if err := requireMongos(ctx, client); err != nil {
+			return nil, err
+		}
+
+		shards, err := findAllConfig(ctx, client, "shards")
+		if err != nil {
+			return nil, err
+		}
+		databases, err := findAllConfig(ctx, client, "databases")
+		if err != nil {
+			return nil, err
+		}
+		collections, err := findAllConfig(ctx, client, "collections")
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(map[string]interface{}{
+			"shards":      shards,
+			"databases":   databases,
+			"collections": collections,
+		})
+	}
+}
+
+type shardedCollection struct {
+	Namespace string           `bson:"_id"`
+	UUID      primitive.Binary `bson:"uuid"`
+	Key       bson.D           `bson:"key"`
+}
+
+// readShardedCollection returns the config.collections entry of a sharded namespace
+func readShardedCollection(ctx context.Context, client *mongo.Client, namespace string) (*shardedCollection, error) {
+	var coll shardedCollection
+	err := client.Database("config").Collection("collections").FindOne(ctx, bson.D{
+		{Key: "_id", Value: namespace},
+	}).Decode(&coll)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("collection %s is not sharded", namespace)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config.collections failed with: %w", err)
+	}
+	return &coll, nil
+}
+
+// chunksFilter selects the chunks of coll, since 5.0 chunks reference the collection uuid instead of its namespace
+func (c *shardedCollection) chunksFilter() bson.D {
+	if len(c.UUID.Data) > 0 {
+		return bson.D{{Key: "uuid", Value: c.UUID}}
+	}
+	return bson.D{{Key: "ns", Value: c.Namespace}}
+}
+
+// countChunks returns the number of chunks of coll owned by each shard
+func countChunks(ctx context.Context, client *mongo.Client, coll *shardedCollection) (map[string]int64, error) {
+	cursor, err := client.Database("config").Collection("chunks").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: coll.chunksFilter()}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$shard"},
+			{Key: "chunks", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading config.chunks failed with: %w", err)
+	}
+	var groups []struct {
+		Shard  string `bson:"_id"`
+		Chunks int64  `bson:"chunks"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, fmt.Errorf("config.chunks cursor failed with: %w", err)
+	}
+	counts := make(map[string]int64, len(groups))
+	for _, g := range groups {
+		counts[g.Shard] = g.Chunks
+	}
+	return counts, nil
+}
+
+type shardOrphans struct {
+	Chunks          int64 `json:"chunks"`
+	OwnedDocuments  int64 `json:"owned-documents"`
+	OrphanDocuments int64 `json:"orphan-documents"`
+}
+
+// shardedDataDistributionMinVersion is the first release with $shardedDataDistribution
+var shardedDataDistributionMinVersion = []int32{6, 0, 3}
+
+// formatVersion prints a buildInfo version as major.minor.patch
+func formatVersion(version []int32) string {
+	//the fourth part of versionArray is a release candidate marker
+	version = version[:min(len(version), 3)]
+	parts := make([]string, len(version))
+	for i, v := range version {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, ".")
+}
+
+// orphanCheck reports per shard how many documents of a sharded collection fall
+// outside the chunk ranges the shard owns. The shards keep this count while
+// filtering by their chunk ranges, it is read through $shardedDataDistribution
+// so the documents themselves are never scanned. Older servers get an unsupported
+// error since they have no such count, it needs MongoDB 6.0.3 or newer.
+func orphanCheck(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		if err := requireMongos(ctx, client); err != nil {
+			return nil, err
+		}
+
+		version, err := serverVersion(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		if !versionAtLeast(version, shardedDataDistributionMinVersion...) {
+			return nil, fmt.Errorf("orphan-check is unsupported on MongoDB %s, it needs 6.0.3 or newer for $shardedDataDistribution", formatVersion(version))
+		}
+
+		namespace := dbname + "." + collectionName
+		coll, err := readShardedCollection(ctx, client, namespace)
+		if err != nil {
+			return nil, err
+		}
+		chunks, err := countChunks(ctx, client, coll)
+		if err != nil {
+			return nil, err
+		}
+
+		cursor, err := client.Database("admin").Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$shardedDataDistribution", Value: bson.D{}}},
+			{{Key: "$match", Value: bson.D{{Key: "ns", Value: namespace}}}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("$shardedDataDistribution failed with: %w", err)
+		}
+		var distribution []struct {
+			Shards []struct {
+				ShardName       string `bson:"shardName"`
+				NumOwnedDocs    int64  `bson:"numOwnedDocuments"`
+				NumOrphanedDocs int64  `bson:"numOrphanedDocs"`
+			} `bson:"shards"`
+		}
+		if err = cursor.All(ctx, &distribution); err != nil {
+			return nil, fmt.Errorf("$shardedDataDistribution cursor failed with: %w", err)
+		}
+
+		result := make(map[string]*shardOrphans)
+		for shard, n := range chunks {
+			result[shard] = &shardOrphans{Chunks: n}
+		}
+		for _, d := range distribution {
+			for _, s := range d.Shards {
+				r, ok := result[s.ShardName]
+				if !ok {
+					//a shard owning no chunks can still hold orphans
+					r = &shardOrphans{}
+					result[s.ShardName] = r
+				}
+				r.OwnedDocuments = s.NumOwnedDocs
+				r.OrphanDocuments = s.NumOrphanedDocs
+			}
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+type balancerState struct {
+	Mode            string `bson:"mode" json:"mode"`
+	InBalancerRound bool   `bson:"inBalancerRound" json:"in-balancer-round"`
+}
+
+// readBalancerState runs balancerStatus, mode is full when the balancer is enabled
+func readBalancerState(ctx context.Context, client *mongo.Client) (*balancerState, error) {
+	var state balancerState
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "balancerStatus", Value: 1}}).Decode(&state)
+	if err != nil {
+		return nil, fmt.Errorf("balancerStatus failed with: %w", err)
+	}
+	return &state, nil
+}
+
+type shardChunks struct {
+	Chunks    int64 `json:"chunks"`
+	Documents int64 `json:"documents"`
+}
+
+type chunkDistributionResult struct {
+	Shards          map[string]*shardChunks `json:"shards"`
+	BalancerEnabled bool                    `json:"balancer-enabled"`
+}
+
+// chunkDistribution counts the chunks and the documents each shard holds for a sharded collection
+func chunkDistribution(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		if err := requireMongos(ctx, client); err != nil {
+			return nil, err
+		}
+
+		coll, err := readShardedCollection(ctx, client, dbname+"."+collectionName)
+		if err != nil {
+			return nil, err
+		}
+		chunks, err := countChunks(ctx, client, coll)
+		if err != nil {
+			return nil, err
+		}
+
+		result := chunkDistributionResult{Shards: make(map[string]*shardChunks)}
+		for shard, n := range chunks {
+			result.Shards[shard] = &shardChunks{Chunks: n}
+		}
+
+		//through mongos $collStats returns one document per shard,
+		//the count comes from collection metadata so it is an estimate
+		cursor, err := client.Database(dbname).Collection(collectionName).Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$collStats", Value: bson.D{{Key: "count", Value: bson.D{}}}}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("$collStats failed with: %w", err)
+		}
+		var stats []struct {
+			Shard string `bson:"shard"`
+			Count int64  `bson:"count"`
+		}
+		if err = cursor.All(ctx, &stats); err != nil {
+			return nil, fmt.Errorf("$collStats cursor failed with: %w", err)
+		}
+		for _, s := range stats {
+			r, ok := result.Shards[s.Shard]
+			if !ok {
+				r = &shardChunks{}
+				result.Shards[s.Shard] = r
+			}
+			r.Documents = s.Count
+		}
+
+		state, err := readBalancerState(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		result.BalancerEnabled = state.Mode != "off"
+
+		return json.Marshal(result)
+	}
+}
+
+func balancerStatus(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+
+		if err := requireMongos(ctx, client); err != nil {
+			return nil, err
+		}
+
+		state, err := readBalancerState(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(state)
+	}
+}
+
+// balancerCommand runs balancerStart or balancerStop and returns the resulting state
+func balancerCommand(client *mongo.Client, command string) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+
+		if err := requireEnabled("MONGO_ALLOW_BALANCER_ADMIN"); err != nil {
+			return nil, err
+		}
+
+		if err := requireMongos(ctx, client); err != nil {
+			return nil, err
+		}
+
+		//balancerStop waits for a running balancer round to finish
+		err := client.Database("admin").RunCommand(ctx, bson.D{{Key: command, Value: 1}}).Err()
+		if err != nil {
+			return nil, fmt.Errorf("%s failed with: %w", command, err)
+		}
+
+		state, err := readBalancerState(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(state)
+	}
+}
+
+// hasSupportingIndex reports whether an index of coll starts with the fields of shardKey
+func hasSupportingIndex(ctx context.Context, coll *mongo.Collection, shardKey bson.D) (bool, error) {
+	//readIndexSpecs leaves out the _id index
+	if len(shardKey) == 1 && shardKey[0].Key == "_id" && sameValue(shardKey[0].Value, int64(1)) {
+		return true, nil
+	}
+	specs, err := readIndexSpecs(ctx, coll)
+	if err != nil {
+		return false, err
+	}
+	for _, spec := range specs {
+		keys, _ := docValue(spec, "key").(bson.D)
+		if len(keys) >= len(shardKey) && sameValue(keys[:len(shardKey)], shardKey) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func enableSharding(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var dbname string
+
+		if err := pod.DecodeArgs(args, &dbname); err != nil {
+			return nil, err
+		}
+
+		if err := requireEnabled("MONGO_ALLOW_SHARDING_ADMIN"); err != nil {
+			return nil, err
+		}
+
+		if err := requireMongos(ctx, client); err != nil {
+			return nil, err
+		}
+
+		var result bson.M
+		err := client.Database("admin").RunCommand(ctx, bson.D{
+			{Key: "enableSharding", Value: dbname},
+		}).Decode(&result)
+		if err != nil {
+			return nil, fmt.Errorf("enableSharding failed with: %w", err)
+		}
+
+		return json.Marshal(result)
+	}
+}
+
+// shardCollection shards a collection on an ordered shard key. A collection that
+// already has documents needs an index starting with the shard key, an empty one
+// gets the index created by the server.
+func shardCollection(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawKey         json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawKey); err != nil {
+			return nil, err
+		}
+
+		if err := requireEnabled("MONGO_ALLOW_SHARDING_ADMIN"); err != nil {
+			return nil, err
+		}
+
+		shardKey, err := decodeIndexKeys(rawKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := requireMongos(ctx, client); err != nil {
+			return nil, err
+		}
+
+		coll := client.Database(dbname).Collection(collectionName)
+		n, err := coll.EstimatedDocumentCount(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("count failed with: %w", err)
+		}
+		if n > 0 {
+			ok, err := hasSupportingIndex(ctx, coll, shardKey)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("%s.%s has no index starting with the shard key, create one first", dbname, collectionName)
+			}
+		}
+
+		cmd := bson.D{
+			{Key: "shardCollection", Value: dbname + "." + collectionName},
+			{Key: "key", Value: shardKey},
+		}
+		if r, ok := boolOption(userOptions, "unique"); ok {
+			cmd = append(cmd, bson.E{Key: "unique", Value: r})
+		}
+		if r, ok := intOption(userOptions, "num-initial-chunks"); ok {
+			cmd = append(cmd, bson.E{Key: "numInitialChunks", Value: r})
+		}
+
+		var result bson.M
+		if err := client.Database("admin").RunCommand(ctx, cmd).Decode(&result); err != nil {
+			return nil, fmt.Errorf("shardCollection failed with: %w", err)
+		}
+
+		return json.Marshal(result)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// socketPermissions holds the NETPOD_SOCKET_MODE and NETPOD_SOCKET_GROUP settings
+type socketPermissions struct {
+	mode    os.FileMode
+	hasMode bool
+	gid     int
+	group   string
+}
+
+// readSocketPermissions validates the socket env vars before the pod starts listening
+func readSocketPermissions() (socketPermissions, error) {
+	perms := socketPermissions{gid: -1}
+	if val := os.Getenv("NETPOD_SOCKET_MODE"); val != "" {
+		mode, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || mode > 0777 {
+			return perms, fmt.Errorf("invalid NETPOD_SOCKET_MODE %q, expected octal like 0660", val)
+		}
+		perms.mode, perms.hasMode = os.FileMode(mode), true
+	}
+	if val := os.Getenv("NETPOD_SOCKET_GROUP"); val != "" {
+		//accept a group name or a numeric gid
+		gid, err := strconv.Atoi(val)
+		if err != nil {
+			g, lerr := user.LookupGroup(val)
+			if lerr != nil {
+				return perms, fmt.Errorf("invalid NETPOD_SOCKET_GROUP %q: %w", val, lerr)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return perms, fmt.Errorf("invalid gid for group %q: %w", val, err)
+			}
+		}
+		perms.gid, perms.group = gid, val
+	}
+	return perms, nil
+}
+
+// ownerOnlyUmask makes pod.Listen create the socket as 0700
+const ownerOnlyUmask = 0077
+
+// restrict sets the umask so the socket pod.Listen creates is only connectable by its owner,
+// the returned func waits for the socket, restores the umask and then sets group and mode
+func (p socketPermissions) restrict(socketPath string) func() {
+	if !p.hasMode && p.gid < 0 {
+		return func() {}
+	}
+	old := syscall.Umask(ownerOnlyUmask)
+	mode := p.mode
+	if !p.hasMode {
+		//the mode the socket would have had without the group setting
+		mode = os.FileMode(0777 &^ old)
+	}
+	return func() {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				syscall.Umask(old)
+				log.Printf("socket %s did not appear, permissions not applied", socketPath)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		//files the handlers write get the usual umask again
+		syscall.Umask(old)
+		if p.gid >= 0 {
+			if err := os.Chown(socketPath, -1, p.gid); err != nil {
+				log.Printf("trouble setting socket group %s, it stays owner only: %v", p.group, err)
+				return
+			}
+			log.Printf("Socket group set to %s", p.group)
+		}
+		if err := os.Chmod(socketPath, mode); err != nil {
+			log.Printf("trouble setting socket mode %o: %v", mode, err)
+		} else {
+			log.Printf("Socket mode set to %04o", mode)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// numberValue converts any bson number to float64
+func numberValue(v interface{}) float64 {
+	switch t := v.(type) {
+	case int32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case float64:
+		return t
+	}
+	return 0
+}
+
+type wiredTigerSummary struct {
+	CacheBytes        float64 `json:"cache-bytes"`
+	PagesRead         float64 `json:"pages-read"`
+	PagesWritten      float64 `json:"pages-written"`
+	FileSizeBytes     float64 `json:"file-size-bytes"`
+	ReusableBytes     float64 `json:"reusable-bytes"`
+	DataSize          float64 `json:"data-size"`
+	StorageSize       float64 `json:"storage-size"`
+	CompressionRatio  float64 `json:"compression-ratio"`
+	CompressedPages   float64 `json:"compressed-pages-written"`
+	UncompressedPages float64 `json:"uncompressed-pages-written"`
+	CreationString    string  `json:"creation-string"`
+}
+
+// wiredTigerStats flattens the wiredTiger part of collStats
+func wiredTigerStats(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		var stats bson.M
+		err := client.Database(dbname).RunCommand(ctx, bson.D{
+			{Key: "collStats", Value: collectionName},
+		}).Decode(&stats)
+		if err != nil {
+			return nil, fmt.Errorf("collStats failed with: %w", err)
+		}
+
+		wt, ok := stats["wiredTiger"].(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("collection %s is not using the wiredTiger storage engine", collectionName)
+		}
+		section := func(name string) bson.M {
+			m, _ := wt[name].(bson.M)
+			return m
+		}
+		cache, block, compression := section("cache"), section("block-manager"), section("compression")
+
+		r := wiredTigerSummary{
+			CacheBytes:        numberValue(cache["bytes currently in the cache"]),
+			PagesRead:         numberValue(cache["pages read into cache"]),
+			PagesWritten:      numberValue(cache["pages written from cache"]),
+			FileSizeBytes:     numberValue(block["file size in bytes"]),
+			ReusableBytes:     numberValue(block["file bytes available for reuse"]),
+			DataSize:          numberValue(stats["size"]),
+			StorageSize:       numberValue(stats["storageSize"]),
+			CompressedPages:   numberValue(compression["compressed pages written"]),
+			UncompressedPages: numberValue(compression["page written failed to compress"]),
+		}
+		r.CreationString, _ = wt["creationString"].(string)
+		if r.StorageSize > 0 {
+			r.CompressionRatio = r.DataSize / r.StorageSize
+		}
+
+		return json.Marshal(r)
+	}
+}
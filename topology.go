@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const maxTopologyEvents = 256
+
+type topologyEvent struct {
+	Time    taggedDate `json:"time"`
+	Kind    string     `json:"kind"`
+	Address string     `json:"address,omitempty"`
+	Detail  string     `json:"detail,omitempty"`
+}
+
+// eventRing keeps the most recent driver discovery and pool events
+type eventRing struct {
+	mu     sync.Mutex
+	events []topologyEvent
+	next   int
+}
+
+var driverEvents = &eventRing{}
+
+func (r *eventRing) add(kind, address, detail string) {
+	e := topologyEvent{Time: newTaggedDate(primitive.NewDateTimeFromTime(time.Now())), Kind: kind, Address: address, Detail: detail}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) < maxTopologyEvents {
+		r.events = append(r.events, e)
+		return
+	}
+	r.events[r.next] = e
+	r.next = (r.next + 1) % maxTopologyEvents
+}
+
+// recent returns up to limit events oldest first
+func (r *eventRing) recent(limit int) []topologyEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ordered := append(append([]topologyEvent{}, r.events[r.next:]...), r.events[:r.next]...)
+	if limit > 0 && limit < len(ordered) {
+		ordered = ordered[len(ordered)-limit:]
+	}
+	return ordered
+}
+
+// serverMonitor records topology changes and failed heartbeats,
+// successful heartbeats arrive every few seconds and are left out
+func (r *eventRing) serverMonitor() *event.ServerMonitor {
+	return &event.ServerMonitor{
+		ServerDescriptionChanged: func(e *event.ServerDescriptionChangedEvent) {
+			r.add("server-description-changed", e.Address.String(),
+				fmt.Sprintf("%s -> %s", e.PreviousDescription.Kind, e.NewDescription.Kind))
+		},
+		ServerOpening: func(e *event.ServerOpeningEvent) {
+			r.add("server-opening", e.Address.String(), "")
+		},
+		ServerClosed: func(e *event.ServerClosedEvent) {
+			r.add("server-closed", e.Address.String(), "")
+		},
+		TopologyDescriptionChanged: func(e *event.TopologyDescriptionChangedEvent) {
+			r.add("topology-description-changed", "",
+				fmt.Sprintf("%s -> %s", e.PreviousDescription.Kind, e.NewDescription.Kind))
+		},
+		TopologyOpening: func(e *event.TopologyOpeningEvent) {
+			r.add("topology-opening", "", "")
+		},
+		TopologyClosed: func(e *event.TopologyClosedEvent) {
+			r.add("topology-closed", "", "")
+		},
+		ServerHeartbeatFailed: func(e *event.ServerHeartbeatFailedEvent) {
+			r.add("server-heartbeat-failed", e.ConnectionID, e.Failure.Error())
+		},
+	}
+}
+
+// poolMonitor records pool state changes, routine check outs and check ins are left out
+func (r *eventRing) poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.GetStarted, event.GetSucceeded, event.ConnectionReturned,
+				event.ConnectionCreated, event.ConnectionReady:
+				return
+			}
+			detail := e.Reason
+			if e.Error != nil {
+				detail = e.Error.Error()
+			}
+			r.add(e.Type, e.Address, detail)
+		},
+	}
+}
+
+func topologyEvents() pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var userOptions map[string]interface{}
+
+		if len(args) == 1 {
+			if err := pod.DecodeArgs(args, &userOptions); err != nil {
+				return nil, err
+			}
+		}
+		applyDefaultOptions(ctx, &userOptions)
+
+		limit, _ := intOption(userOptions, "limit")
+
+		return json.Marshal(driverEvents.recent(int(limit)))
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// taggedValue converts a single key tagged document such as
+// {"ObjectId": "000000000000000000000000"}, {"ISODate": "2024-01-01T00:00:00Z"},
+// {"Timestamp": {"t": 1, "i": 1}}, {"Int64": "5"}, {"Int32": 5} or {"Double": 5}
+// into its bson value
+func taggedValue(key string, val interface{}) (interface{}, bool) {
+	switch key {
+	case "ObjectId":
+		if hex, ok := val.(string); ok {
+			if oid, err := primitive.ObjectIDFromHex(hex); err == nil {
+				return oid, true
+			}
+		}
+	case "Int64":
+		//a string keeps integers beyond 2^53 exact
+		if str, ok := val.(string); ok {
+			if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+				return i, true
+			}
+			return nil, false
+		}
+		if f, ok := integralNumber(val); ok {
+			return int64(f), true
+		}
+	case "Int32":
+		if f, ok := integralNumber(val); ok && f >= math.MinInt32 && f <= math.MaxInt32 {
+			return int32(f), true
+		}
+	case "Double":
+		switch t := val.(type) {
+		case string:
+			if f, err := strconv.ParseFloat(t, 64); err == nil {
+				return f, true
+			}
+		case int32, int64, float64:
+			return numberValue(t), true
+		}
+	case "ISODate":
+		if str, ok := val.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, str); err == nil {
+				return primitive.NewDateTimeFromTime(t), true
+			}
+		}
+	case "Timestamp":
+		var t, i interface{}
+		switch ts := val.(type) {
+		case map[string]interface{}:
+			t, i = ts["t"], ts["i"]
+		case bson.D:
+			t, i = docValue(ts, "t"), docValue(ts, "i")
+		default:
+			return nil, false
+		}
+		if t == nil || i == nil {
+			return nil, false
+		}
+		return primitive.Timestamp{T: uint32(numberValue(t)), I: uint32(numberValue(i))}, true
+	}
+	return nil, false
+}
+
+type timestampParts struct {
+	T uint32 `json:"t"`
+	I uint32 `json:"i"`
+}
+
+// taggedTimestamp is the json form of a Timestamp accepted back by taggedValue
+type taggedTimestamp struct {
+	Timestamp timestampParts `json:"Timestamp"`
+}
+
+// integralNumber returns a decoded json number that has no fractional part
+func integralNumber(val interface{}) (float64, bool) {
+	switch val.(type) {
+	case int32, int64, float64:
+		f := numberValue(val)
+		return f, f == math.Trunc(f)
+	}
+	return 0, false
+}
+
+// taggedDate is the json form of a date accepted back by taggedValue
+type taggedDate struct {
+	ISODate string `json:"ISODate"`
+}
+
+func newTaggedDate(dt primitive.DateTime) taggedDate {
+	return taggedDate{ISODate: dt.Time().UTC().Format(time.RFC3339Nano)}
+}
+
+func newTaggedTimestamp(ts *primitive.Timestamp) *taggedTimestamp {
+	if ts == nil {
+		return nil
+	}
+	return &taggedTimestamp{Timestamp: timestampParts{T: ts.T, I: ts.I}}
+}
+
+// convertValue walks decoded json converting tagged values at any depth
+func convertValue(v interface{}) interface{} {
+	return convertTagged(v, true)
+}
+
+// convertTagged is convertValue, with oids false {"ObjectId": ...} documents are left as they are
+func convertTagged(v interface{}, oids bool) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 1 {
+			for key, val := range t {
+				if r, ok := taggedValue(key, val); ok && (oids || key != "ObjectId") {
+					return r
+				}
+			}
+		}
+		m := make(map[string]interface{}, len(t))
+		for key, val := range t {
+			m[key] = convertTagged(val, oids)
+		}
+		return m
+	case bson.D:
+		if len(t) == 1 {
+			if r, ok := taggedValue(t[0].Key, t[0].Value); ok && (oids || t[0].Key != "ObjectId") {
+				return r
+			}
+		}
+		d := make(bson.D, len(t))
+		for i, e := range t {
+			d[i] = bson.E{Key: e.Key, Value: convertTagged(e.Value, oids)}
+		}
+		return d
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, val := range t {
+			a[i] = convertTagged(val, oids)
+		}
+		return a
+	case bson.A:
+		a := make(bson.A, len(t))
+		for i, val := range t {
+			a[i] = convertTagged(val, oids)
+		}
+		return a
+	}
+	return v
+}
+
+// decodeOrdered decodes json keeping the key order of objects by using bson.D,
+// integral numbers become int64 and tagged values are converted
+func decodeOrdered(data []byte) (interface{}, error) {
+	return decodeTagged(data, true)
+}
+
+// decodeTagged is decodeOrdered, oids false keeps {"ObjectId": ...} documents as documents
+func decodeTagged(data []byte, oids bool) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	val, err := readOrdered(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after json value")
+	}
+	return convertTagged(val, oids), nil
+}
+
+func readOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			d := bson.D{}
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key, _ := keyTok.(string)
+				val, err := readOrdered(dec)
+				if err != nil {
+					return nil, err
+				}
+				d = append(d, bson.E{Key: key, Value: val})
+			}
+			_, err := dec.Token()
+			return d, err
+		case '[':
+			a := bson.A{}
+			for dec.More() {
+				val, err := readOrdered(dec)
+				if err != nil {
+					return nil, err
+				}
+				a = append(a, val)
+			}
+			_, err := dec.Token()
+			return a, err
+		}
+		return nil, fmt.Errorf("unexpected json delimiter %v", t)
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	}
+	return tok, nil
+}
+
+// decodePipeline decodes an aggregation pipeline argument
+func decodePipeline(data json.RawMessage) (bson.A, error) {
+	val, err := decodeOrdered(data)
+	if err != nil {
+		return nil, fmt.Errorf("trouble decoding pipeline: %w", err)
+	}
+	pipeline, ok := val.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("pipeline must be an array")
+	}
+	return pipeline, nil
+}
+
+// docValue returns the value of key in d or nil
+func docValue(d bson.D, key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+// toM converts an ordered document into bson.M so it encodes as a json object
+func toM(doc interface{}) (bson.M, error) {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var m bson.M
+	if err := bson.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
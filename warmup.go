@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const warmUpTimeout = 10 * time.Second
+
+// readWarmUpConnections reads MONGO_WARMUP_CONNECTIONS, 0 when unset
+func readWarmUpConnections() (uint64, error) {
+	val := os.Getenv("MONGO_WARMUP_CONNECTIONS")
+	if val == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid MONGO_WARMUP_CONNECTIONS %q, expected a number of connections", val)
+	}
+	return n, nil
+}
+
+// defaultMaxPoolSize is the driver pool size when maxPoolSize is not set
+const defaultMaxPoolSize = 100
+
+// keepWarm raises minPoolSize to n so the pool holds on to the warmed up connections,
+// n above maxPoolSize is an error since the driver refuses to connect with it
+func keepWarm(clientOptions *options.ClientOptions, n uint64) error {
+	max := uint64(defaultMaxPoolSize)
+	if clientOptions.MaxPoolSize != nil {
+		max = *clientOptions.MaxPoolSize
+	}
+	//a maxPoolSize of 0 means no limit
+	if max > 0 && n > max {
+		return fmt.Errorf("MONGO_WARMUP_CONNECTIONS %d exceeds the pool size of %d, lower it or raise maxPoolSize", n, max)
+	}
+	if clientOptions.MinPoolSize == nil || *clientOptions.MinPoolSize < n {
+		clientOptions.SetMinPoolSize(n)
+	}
+	return nil
+}
+
+// warmUp opens connections by running n pings at once, failures are only logged
+// since the pod works with a cold pool too
+func warmUp(client *mongo.Client, n uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), warmUpTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var failed atomic.Int64
+	runBounded(int(n), int64(n), func(int) {
+		if err := client.Ping(ctx, nil); err != nil {
+			failed.Add(1)
+		}
+	})
+	if f := failed.Load(); f > 0 {
+		log.Printf("Warm-up finished in %s, %d of %d pings failed", time.Since(start), f, n)
+		return
+	}
+	log.Printf("Warm-up of %d connections finished in %s", n, time.Since(start))
+}
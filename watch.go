@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultWatchBatchSize  = 100
+	defaultWatchMaxAwaitMs = 1000
+)
+
+var watchOperationTypes = map[string]bool{
+	"insert":  true,
+	"update":  true,
+	"delete":  true,
+	"replace": true,
+}
+
+type changeBatch struct {
+	Events      []bson.M `json:"events"`
+	ResumeToken bson.M   `json:"resume-token"`
+}
+
+// watchPipeline builds the $match stage for the "operation-types" option
+func watchPipeline(userOptions map[string]interface{}) (mongo.Pipeline, error) {
+	pipeline := mongo.Pipeline{}
+	val, ok := userOptions["operation-types"]
+	if !ok {
+		return pipeline, nil
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected value for operation-types: %v", val)
+	}
+	for _, item := range list {
+		if r, ok := item.(string); !ok || !watchOperationTypes[r] {
+			return nil, fmt.Errorf("unsupported operation type: %v", item)
+		}
+	}
+	return append(pipeline, bson.D{{Key: "$match", Value: bson.D{
+		{Key: "operationType", Value: bson.D{{Key: "$in", Value: list}}},
+	}}}), nil
+}
+
+var fullDocumentModes = map[string]options.FullDocument{
+	"default":       options.Default,
+	"off":           options.Off,
+	"updateLookup":  options.UpdateLookup,
+	"whenAvailable": options.WhenAvailable,
+	"required":      options.Required,
+}
+
+// fullDocumentOption reads a full document mode option
+func fullDocumentOption(userOptions map[string]interface{}, name string) (options.FullDocument, bool, error) {
+	val, ok := userOptions[name]
+	if !ok {
+		return "", false, nil
+	}
+	r, _ := val.(string)
+	mode, ok := fullDocumentModes[r]
+	if !ok {
+		return "", false, fmt.Errorf("unexpected value for %s: %v", name, val)
+	}
+	return mode, true, nil
+}
+
+// changeStreamOptions maps the shared watch options
+func changeStreamOptions(userOptions map[string]interface{}) (*options.ChangeStreamOptions, error) {
+	maxAwaitMs := int64(defaultWatchMaxAwaitMs)
+	if r, ok := intOption(userOptions, "max-await-ms"); ok {
+		maxAwaitMs = r
+	}
+	opts := options.ChangeStream().SetMaxAwaitTime(time.Duration(maxAwaitMs) * time.Millisecond)
+	if token, ok := userOptions["resume-after"]; ok {
+		opts.SetResumeAfter(token)
+	}
+
+	mode, ok, err := fullDocumentOption(userOptions, "full-document")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		opts.SetFullDocument(mode)
+	}
+	mode, ok, err = fullDocumentOption(userOptions, "full-document-before-change")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		opts.SetFullDocumentBeforeChange(mode)
+	}
+	return opts, nil
+}
+
+// requirePreImages checks that a collection records the pre images
+// needed by the full-document-before-change option
+func requirePreImages(ctx context.Context, database *mongo.Database, collectionName string, userOptions map[string]interface{}) error {
+	mode, ok, err := fullDocumentOption(userOptions, "full-document-before-change")
+	if err != nil || !ok || mode == options.Off {
+		return err
+	}
+	spec, err := readCollectionSpec(ctx, database, collectionName)
+	if err != nil {
+		return err
+	}
+	var images struct {
+		ChangeStreamPreAndPostImages struct {
+			Enabled bool `bson:"enabled"`
+		} `bson:"changeStreamPreAndPostImages"`
+	}
+	if b, err := bson.Marshal(spec.Options); err == nil {
+		_ = bson.Unmarshal(b, &images)
+	}
+	if !images.ChangeStreamPreAndPostImages.Enabled {
+		return fmt.Errorf("full-document-before-change needs changeStreamPreAndPostImages enabled on %s", collectionName)
+	}
+	return nil
+}
+
+// collectChanges reads up to "batch-size" events from stream waiting at most "max-await-ms"
+// and returns them together with the token to resume from on the next call
+func collectChanges(ctx context.Context, stream *mongo.ChangeStream, userOptions map[string]interface{}) (json.RawMessage, error) {
+	defer stream.Close(ctx)
+
+	batchSize := int64(defaultWatchBatchSize)
+	if r, ok := intOption(userOptions, "batch-size"); ok && r > 0 {
+		batchSize = r
+	}
+	maxAwaitMs := int64(defaultWatchMaxAwaitMs)
+	if r, ok := intOption(userOptions, "max-await-ms"); ok {
+		maxAwaitMs = r
+	}
+
+	batch := changeBatch{Events: []bson.M{}}
+	deadline := time.Now().Add(time.Duration(maxAwaitMs) * time.Millisecond)
+	for int64(len(batch.Events)) < batchSize && time.Now().Before(deadline) {
+		if stream.TryNext(ctx) {
+			var event bson.M
+			if err := stream.Decode(&event); err != nil {
+				return nil, fmt.Errorf("trouble decoding change event: %w", err)
+			}
+			batch.Events = append(batch.Events, event)
+			continue
+		}
+		if err := stream.Err(); err != nil {
+			return nil, fmt.Errorf("change stream failed with: %w", err)
+		}
+	}
+
+	if token := stream.ResumeToken(); token != nil {
+		if err := bson.Unmarshal(token, &batch.ResumeToken); err != nil {
+			return nil, fmt.Errorf("trouble decoding resume token: %w", err)
+		}
+	}
+
+	return json.Marshal(batch)
+}
+
+func watchAll(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var userOptions map[string]interface{}
+
+		if len(args) == 1 {
+			if err := pod.DecodeArgs(args, &userOptions); err != nil {
+				return nil, err
+			}
+		}
+		applyDefaultOptions(ctx, &userOptions)
+
+		pipeline, err := watchPipeline(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		opts, err := changeStreamOptions(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := client.Watch(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("watch failed with: %w", err)
+		}
+
+		return collectChanges(ctx, stream, userOptions)
+	}
+}
+
+func watchCollection(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName); err != nil {
+			return nil, err
+		}
+
+		pipeline, err := watchPipeline(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		opts, err := changeStreamOptions(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		database := client.Database(dbname)
+		if err := requirePreImages(ctx, database, collectionName, userOptions); err != nil {
+			return nil, err
+		}
+
+		stream, err := database.Collection(collectionName).Watch(ctx, pipeline, opts)
+		if err != nil {
+			return nil, fmt.Errorf("watch failed with: %w", err)
+		}
+
+		return collectChanges(ctx, stream, userOptions)
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jlabath/netpod/server/pod"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type updateResult struct {
+	MatchedCount               int64           `json:"matched-count"`
+	ModifiedCount              int64           `json:"modified-count"`
+	UpsertedCount              int64           `json:"upserted-count"`
+	UpsertedID                 interface{}     `json:"upserted-id,omitempty"`
+	BypassedDocumentValidation bool            `json:"bypassed-document-validation,omitempty"`
+	Ids                        json.RawMessage `json:"ids,omitempty"`
+}
+
+// bypassValidationOption reads "bypass-document-validation" which only
+// works when the pod runs with MONGO_ALLOW_BYPASS_VALIDATION
+func bypassValidationOption(userOptions map[string]interface{}) (bool, error) {
+	bypass, _ := boolOption(userOptions, "bypass-document-validation")
+	if bypass {
+		if err := requireEnabled("MONGO_ALLOW_BYPASS_VALIDATION"); err != nil {
+			return false, err
+		}
+	}
+	return bypass, nil
+}
+
+func newUpdateResult(r *mongo.UpdateResult) updateResult {
+	return updateResult{
+		MatchedCount:  r.MatchedCount,
+		ModifiedCount: r.ModifiedCount,
+		UpsertedCount: r.UpsertedCount,
+		UpsertedID:    r.UpsertedID,
+	}
+}
+
+// decodeUpdate decodes an update document, or when given a json array
+// an aggregation pipeline update so fields can be computed from other fields.
+// Documents are decoded as bson.D at every depth so the field order
+// the caller sent is the order the server sees.
+func decodeUpdate(data json.RawMessage, format string) (interface{}, error) {
+	val, err := decodeValue(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("trouble decoding update: %w", err)
+	}
+	switch t := val.(type) {
+	case bson.D:
+		return t, nil
+	case bson.A:
+		pipeline := make(mongo.Pipeline, len(t))
+		for i, stage := range t {
+			d, ok := stage.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("update pipeline stage %d must be a document", i)
+			}
+			pipeline[i] = d
+		}
+		return pipeline, nil
+	}
+	return nil, fmt.Errorf("update must be a document or a pipeline")
+}
+
+// runUpdateMany applies update to every document matching rawFilter,
+// it is shared by update-many and the field helpers built on top of it
+func runUpdateMany(ctx context.Context, client *mongo.Client, dbname, collectionName string, rawFilter json.RawMessage, update interface{}, userOptions map[string]interface{}) (json.RawMessage, error) {
+	conn, release, err := resolveClient(ctx, client, userOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	coll := conn.Database(dbname).Collection(collectionName)
+
+	format, err := formatOption(userOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := decodeFilter(rawFilter, format, userOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err = sessionContext(ctx, userOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	bypass, err := bypassValidationOption(userOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	//populate options
+	opts := options.Update()
+	if comment, ok := correlationComment(ctx); ok {
+		opts.SetComment(comment)
+	}
+	if r, ok := boolOption(userOptions, "upsert"); ok {
+		opts.SetUpsert(r)
+	}
+	if bypass {
+		opts.SetBypassDocumentValidation(true)
+	}
+
+	result, err := coll.UpdateMany(ctx, filter, update, opts)
+	if err != nil {
+		return nil, fmt.Errorf("updateMany failed with: %w", err)
+	}
+
+	r := newUpdateResult(result)
+	r.BypassedDocumentValidation = bypass
+
+	//return-ids reruns the filter after the update so it is best effort,
+	//documents the update moved out of the filter are missing and documents
+	//written concurrently by others can show up
+	if returnIds, _ := boolOption(userOptions, "return-ids"); returnIds {
+		cursor, err := coll.Find(ctx, filter, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+		if err != nil {
+			return nil, fmt.Errorf("finding updated ids failed with: %w", err)
+		}
+		docs := []bson.M{}
+		if err = cursor.All(ctx, &docs); err != nil {
+			return nil, fmt.Errorf("updated ids cursor failed with: %w", err)
+		}
+		if r.Ids, err = encodeIds(docs, format); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(r)
+}
+
+func updateMany(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			rawUpdate      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &rawUpdate); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		update, err := decodeUpdate(rawUpdate, format)
+		if err != nil {
+			return nil, err
+		}
+
+		return runUpdateMany(ctx, client, dbname, collectionName, rawFilter, update, userOptions)
+	}
+}
+
+// setField is sugar for update-many with {"$set": {field: value}}
+func setField(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			field          string
+			rawValue       json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &field, &rawValue); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		//converts tagged values like {"ObjectId": ...}
+		value, err := decodeValue(rawValue, format)
+		if err != nil {
+			return nil, fmt.Errorf("trouble decoding value: %w", err)
+		}
+
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: field, Value: value}}}}
+		return runUpdateMany(ctx, client, dbname, collectionName, rawFilter, update, userOptions)
+	}
+}
+
+func nextSequence(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			sequenceName   string
+		)
+
+		if err := pod.DecodeArgs(args, &dbname, &collectionName, &sequenceName); err != nil {
+			return nil, err
+		}
+
+		coll := client.Database(dbname).Collection(collectionName)
+
+		//increment by an int64 so the stored counter never turns into a double
+		opts := options.FindOneAndUpdate().
+			SetUpsert(true).
+			SetReturnDocument(options.After)
+
+		var counter struct {
+			Seq int64 `bson:"seq"`
+		}
+		err := coll.FindOneAndUpdate(
+			ctx,
+			bson.D{{Key: "_id", Value: sequenceName}},
+			bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: int64(1)}}}},
+			opts,
+		).Decode(&counter)
+		if err != nil {
+			return nil, fmt.Errorf("next sequence %s failed with: %w", sequenceName, err)
+		}
+
+		return json.Marshal(counter.Seq)
+	}
+}
+
+// maxDocumentSize is the server limit on a single BSON document
+const maxDocumentSize = 16 * 1024 * 1024
+
+type documentTooLargeError struct {
+	Index int
+	Size  int
+}
+
+func (e *documentTooLargeError) Error() string {
+	return fmt.Sprintf(
+		"document at index %d is %d bytes which exceeds the %d byte BSON limit, consider storing it with GridFS",
+		e.Index, e.Size, maxDocumentSize)
+}
+
+// decodeDocuments decodes a document or an array of documents to insert
+// and checks each against the BSON size limit before anything is sent
+func decodeDocuments(data json.RawMessage, format string) ([]interface{}, error) {
+	val, err := decodeValue(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("trouble decoding documents: %w", err)
+	}
+	var docs []interface{}
+	switch t := val.(type) {
+	case bson.D:
+		docs = []interface{}{t}
+	case bson.A:
+		docs = []interface{}(t)
+	default:
+		return nil, fmt.Errorf("expected a document or an array of documents")
+	}
+	for i, doc := range docs {
+		if _, ok := doc.(bson.D); !ok {
+			return nil, fmt.Errorf("value at index %d is not a document", i)
+		}
+		b, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("trouble encoding document at index %d: %w", i, err)
+		}
+		if len(b) > maxDocumentSize {
+			return nil, &documentTooLargeError{Index: i, Size: len(b)}
+		}
+	}
+	return docs, nil
+}
+
+func insertOne(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawDoc         json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawDoc); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		docs, err := decodeDocuments(rawDoc, format)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) != 1 {
+			return nil, fmt.Errorf("insert-one expects a single document")
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		ctx, err = sessionContext(ctx, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		bypass, err := bypassValidationOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := options.InsertOne()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if bypass {
+			opts.SetBypassDocumentValidation(true)
+		}
+
+		result, err := conn.Database(dbname).Collection(collectionName).InsertOne(ctx, docs[0], opts)
+		if err != nil {
+			return nil, fmt.Errorf("insertOne failed with: %w", err)
+		}
+
+		r := map[string]interface{}{"inserted-id": result.InsertedID}
+		if bypass {
+			r["bypassed-document-validation"] = true
+		}
+		return json.Marshal(r)
+	}
+}
+
+func insertMany(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawDocs        json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawDocs); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		docs, err := decodeDocuments(rawDocs, format)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		ctx, err = sessionContext(ctx, userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		bypass, err := bypassValidationOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		//populate options
+		opts := options.InsertMany()
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if r, ok := boolOption(userOptions, "ordered"); ok {
+			opts.SetOrdered(r)
+		}
+		if bypass {
+			opts.SetBypassDocumentValidation(true)
+		}
+
+		result, err := conn.Database(dbname).Collection(collectionName).InsertMany(ctx, docs, opts)
+		if err != nil {
+			return nil, fmt.Errorf("insertMany failed with: %w", err)
+		}
+
+		r := map[string]interface{}{"inserted-ids": result.InsertedIDs}
+		if bypass {
+			r["bypassed-document-validation"] = true
+		}
+		return json.Marshal(r)
+	}
+}
+
+// unsetField removes one field or a list of fields, dotted paths reach into sub documents
+func unsetField(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			rawFields      json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &rawFields); err != nil {
+			return nil, err
+		}
+
+		var fields []string
+		if err := json.Unmarshal(rawFields, &fields); err != nil {
+			var field string
+			if err := json.Unmarshal(rawFields, &field); err != nil {
+				return nil, fmt.Errorf("fields must be a string or a list of strings")
+			}
+			fields = []string{field}
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("no fields to unset")
+		}
+
+		unset := bson.D{}
+		for _, field := range fields {
+			unset = append(unset, bson.E{Key: field, Value: ""})
+		}
+
+		update := bson.D{{Key: "$unset", Value: unset}}
+		return runUpdateMany(ctx, client, dbname, collectionName, rawFilter, update, userOptions)
+	}
+}
+
+// renameField renames a field with $rename, it refuses when documents already
+// have the new field since $rename would overwrite it unless "overwrite" is set
+func renameField(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			rawFilter      json.RawMessage
+			oldName        string
+			newName        string
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &rawFilter, &oldName, &newName); err != nil {
+			return nil, err
+		}
+
+		if oldName == newName {
+			return nil, fmt.Errorf("old and new field names are the same")
+		}
+
+		if overwrite, _ := boolOption(userOptions, "overwrite"); !overwrite {
+			format, err := formatOption(userOptions)
+			if err != nil {
+				return nil, err
+			}
+			filter, err := decodeFilter(rawFilter, format, userOptions)
+			if err != nil {
+				return nil, err
+			}
+			conn, release, err := resolveClient(ctx, client, userOptions)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			clash := bson.D{{Key: "$and", Value: bson.A{
+				filter,
+				bson.D{{Key: oldName, Value: bson.D{{Key: "$exists", Value: true}}}},
+				bson.D{{Key: newName, Value: bson.D{{Key: "$exists", Value: true}}}},
+			}}}
+			countOpts := options.Count()
+			if comment, ok := correlationComment(ctx); ok {
+				countOpts.SetComment(comment)
+			}
+			n, err := conn.Database(dbname).Collection(collectionName).CountDocuments(ctx, clash, countOpts)
+			if err != nil {
+				return nil, fmt.Errorf("checking for existing %s failed with: %w", newName, err)
+			}
+			if n > 0 {
+				return nil, fmt.Errorf("%d documents already have %s and would be overwritten, set overwrite to proceed", n, newName)
+			}
+		}
+
+		update := bson.D{{Key: "$rename", Value: bson.D{{Key: oldName, Value: newName}}}}
+		return runUpdateMany(ctx, client, dbname, collectionName, rawFilter, update, userOptions)
+	}
+}
+
+type insertIfAbsentResult struct {
+	Inserted                   bool            `json:"inserted"`
+	ID                         json.RawMessage `json:"id"`
+	BypassedDocumentValidation bool            `json:"bypassed-document-validation,omitempty"`
+}
+
+// insertIfAbsent inserts doc unless a document with the same value of keyField exists,
+// concurrent calls need a unique index on keyField to never insert twice
+func insertIfAbsent(client *mongo.Client) pod.Handler {
+
+	return func(ctx context.Context, args []json.RawMessage) (json.RawMessage, error) {
+		var (
+			dbname         string
+			collectionName string
+			keyField       string
+			rawDoc         json.RawMessage
+			userOptions    map[string]interface{}
+		)
+
+		if err := decodeArgsWithOptions(ctx, args, &userOptions, &dbname, &collectionName, &keyField, &rawDoc); err != nil {
+			return nil, err
+		}
+
+		format, err := formatOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		docs, err := decodeDocuments(rawDoc, format)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) != 1 {
+			return nil, fmt.Errorf("insert-if-absent takes a single document")
+		}
+		doc, _ := docs[0].(bson.D)
+		key := pathValue(doc, keyField)
+		if key == nil {
+			return nil, fmt.Errorf("document has no value for %s", keyField)
+		}
+
+		bypass, err := bypassValidationOption(userOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := options.Update().SetUpsert(true)
+		if comment, ok := correlationComment(ctx); ok {
+			opts.SetComment(comment)
+		}
+		if bypass {
+			opts.SetBypassDocumentValidation(true)
+		}
+
+		conn, release, err := resolveClient(ctx, client, userOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		result, err := conn.Database(dbname).Collection(collectionName).UpdateOne(
+			ctx,
+			bson.D{{Key: keyField, Value: key}},
+			bson.D{{Key: "$setOnInsert", Value: doc}},
+			opts,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("insert-if-absent failed with: %w", err)
+		}
+
+		r := insertIfAbsentResult{Inserted: result.UpsertedCount == 1, ID: json.RawMessage("null"), BypassedDocumentValidation: bypass}
+		if r.Inserted {
+			if r.ID, err = encodePageID(result.UpsertedID, format); err != nil {
+				return nil, err
+			}
+		}
+
+		return json.Marshal(r)
+	}
+}
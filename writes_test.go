@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestDecodeUpdatePipeline(t *testing.T) {
+	raw := json.RawMessage(`[
+		{"$set": {"b": "$a", "total": {"$add": ["$a", "$c"]}}},
+		{"$set": {"updatedAt": {"ISODate": "2024-01-02T03:04:05Z"}}},
+		{"$unset": "tmp"}
+	]`)
+
+	update, err := decodeUpdate(raw, formatTagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, ok := update.(mongo.Pipeline)
+	if !ok {
+		t.Fatalf("expected a mongo.Pipeline but got %T", update)
+	}
+
+	at := primitive.NewDateTimeFromTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	want := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "b", Value: "$a"},
+			{Key: "total", Value: bson.D{{Key: "$add", Value: bson.A{"$a", "$c"}}}},
+		}}},
+		{{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: at}}}},
+		{{Key: "$unset", Value: "tmp"}},
+	}
+	if !reflect.DeepEqual(pipeline, want) {
+		t.Fatalf("unexpected pipeline\n got: %#v\nwant: %#v", pipeline, want)
+	}
+}
+
+func TestDecodeUpdateRejectsBadStage(t *testing.T) {
+	if _, err := decodeUpdate(json.RawMessage(`[{"$set": {"a": 1}}, 5]`), formatTagged); err == nil {
+		t.Fatal("expected an error for a stage that is not a document")
+	}
+}
+
+func TestDecodeUpdateDocument(t *testing.T) {
+	update, err := decodeUpdate(json.RawMessage(`{"$set": {"z": 1, "a": {"y": 2, "b": 3}}}`), formatTagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "z", Value: int64(1)},
+		{Key: "a", Value: bson.D{{Key: "y", Value: int64(2)}, {Key: "b", Value: int64(3)}}},
+	}}}
+	if !reflect.DeepEqual(update, want) {
+		t.Fatalf("unexpected update\n got: %#v\nwant: %#v", update, want)
+	}
+}
+
+func TestDecodeDocumentsExtendedJSON(t *testing.T) {
+	docs, err := decodeDocuments(json.RawMessage(`[{"_id": {"$oid": "000000000000000000000001"}, "n": {"$numberLong": "5"}}]`), formatEJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid, _ := primitive.ObjectIDFromHex("000000000000000000000001")
+	want := []interface{}{bson.D{{Key: "_id", Value: oid}, {Key: "n", Value: int64(5)}}}
+	if !reflect.DeepEqual(docs, want) {
+		t.Fatalf("unexpected documents\n got: %#v\nwant: %#v", docs, want)
+	}
+
+	update, err := decodeUpdate(json.RawMessage(`{"$set": {"at": {"$date": "2024-01-01T00:00:00Z"}}}`), formatEJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := primitive.NewDateTimeFromTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	wantUpdate := bson.D{{Key: "$set", Value: bson.D{{Key: "at", Value: at}}}}
+	if !reflect.DeepEqual(update, wantUpdate) {
+		t.Fatalf("unexpected update\n got: %#v\nwant: %#v", update, wantUpdate)
+	}
+}
+
+// evalExpr evaluates the few aggregation expressions the pipeline update test uses
+func evalExpr(t *testing.T, doc bson.D, expr interface{}) interface{} {
+	t.Helper()
+	switch e := expr.(type) {
+	case string:
+		if len(e) > 1 && e[0] == '$' {
+			return docValue(doc, e[1:])
+		}
+		return e
+	case bson.D:
+		if len(e) != 1 {
+			t.Fatalf("unsupported expression %#v", e)
+		}
+		args, _ := e[0].Value.(bson.A)
+		switch e[0].Key {
+		case "$add", "$multiply":
+			result := int64(0)
+			if e[0].Key == "$multiply" {
+				result = 1
+			}
+			for _, arg := range args {
+				n, ok := evalExpr(t, doc, arg).(int64)
+				if !ok {
+					t.Fatalf("%s needs integers, got %#v", e[0].Key, arg)
+				}
+				if e[0].Key == "$add" {
+					result += n
+				} else {
+					result *= n
+				}
+			}
+			return result
+		}
+		t.Fatalf("unsupported operator %s", e[0].Key)
+	}
+	return expr
+}
+
+// applyPipeline runs the $set and $unset stages of an update pipeline on doc
+func applyPipeline(t *testing.T, doc bson.D, pipeline mongo.Pipeline) bson.D {
+	t.Helper()
+	for _, stage := range pipeline {
+		switch stage[0].Key {
+		case "$set":
+			fields, _ := stage[0].Value.(bson.D)
+			next := append(bson.D{}, doc...)
+			for _, f := range fields {
+				value := evalExpr(t, doc, f.Value)
+				replaced := false
+				for i := range next {
+					if next[i].Key == f.Key {
+						next[i].Value, replaced = value, true
+					}
+				}
+				if !replaced {
+					next = append(next, bson.E{Key: f.Key, Value: value})
+				}
+			}
+			doc = next
+		case "$unset":
+			next := bson.D{}
+			for _, e := range doc {
+				if e.Key != stage[0].Value {
+					next = append(next, e)
+				}
+			}
+			doc = next
+		default:
+			t.Fatalf("unsupported stage %s", stage[0].Key)
+		}
+	}
+	return doc
+}
+
+func TestPipelineUpdateComputesFieldFromFields(t *testing.T) {
+	update, err := decodeUpdate(json.RawMessage(`[
+		{"$set": {"total": {"$multiply": ["$price", "$qty"]}, "copy": "$price"}},
+		{"$set": {"total": {"$add": ["$total", 1]}}},
+		{"$unset": "tmp"}
+	]`), formatTagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, ok := update.(mongo.Pipeline)
+	if !ok {
+		t.Fatalf("expected a mongo.Pipeline but got %T", update)
+	}
+
+	doc := bson.D{{Key: "price", Value: int64(4)}, {Key: "qty", Value: int64(3)}, {Key: "tmp", Value: true}}
+	got := applyPipeline(t, doc, pipeline)
+	want := bson.D{
+		{Key: "price", Value: int64(4)},
+		{Key: "qty", Value: int64(3)},
+		{Key: "total", Value: int64(13)},
+		{Key: "copy", Value: int64(4)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected updated document\n got: %#v\nwant: %#v", got, want)
+	}
+}